@@ -0,0 +1,250 @@
+package ms
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/cevatbarisyilmaz/ms/internal/mimeutil"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// Actions of the recipients in delivery status notifications (RFC 3464)
+const (
+	ActionFailed    = "failed"
+	ActionDelayed   = "delayed"
+	ActionDelivered = "delivered"
+	ActionRelayed   = "relayed"
+	ActionExpanded  = "expanded"
+)
+
+// BounceRecipient is the outcome reported for a single recipient in a bounce
+type BounceRecipient struct {
+	// Recipient is the email address the original mail was sent to
+	Recipient string
+	// Action is one of the Action constants
+	Action string
+	// Status is the enhanced status code (RFC 3463) such as 5.1.1, it is empty if unknown
+	Status string
+	// RemoteMTA is the host that rejected the mail if known
+	RemoteMTA string
+	// Diagnostic is the reply of the remote host or a human readable explanation
+	Diagnostic string
+}
+
+// Bounce is a parsed bounce or delivery status notification
+type Bounce struct {
+	// MessageID is the Message-ID of the original mail, it is empty if the bounce does not include it
+	MessageID string
+	// Recipients are the recipients the bounce reports about
+	Recipients []*BounceRecipient
+	// Standard reports whether the bounce is a multipart/report DSN (RFC 3464)
+	// Otherwise the recipients are extracted heuristically from the text of the bounce
+	Standard bool
+}
+
+// ParseBounce parses a bounce message
+// Both multipart/report delivery status notifications (RFC 3464) and common non-standard formats are supported
+// rcptTo is the envelope recipient the bounce is received for, it can be empty
+// If rcptTo is a VERP address and the bounce doesn't name any recipient, the recipient encoded in rcptTo is used
+func ParseBounce(r io.Reader, rcptTo string) (*Bounce, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading bounce failed")
+	}
+	bounce := &Bounce{}
+	var texts [][]byte
+	err = bounce.parsePart(textproto.MIMEHeader(msg.Header), msg.Body, &texts)
+	if err != nil {
+		return nil, err
+	}
+	if !bounce.Standard {
+		bounce.Recipients = parseBounceText(texts)
+	}
+	if bounce.MessageID == "" {
+		for _, text := range texts {
+			if match := messageIDPattern.FindSubmatch(text); match != nil {
+				bounce.MessageID = string(match[1])
+				break
+			}
+		}
+	}
+	if _, recipient, ok := DecodeVERP(rcptTo); ok {
+		if len(bounce.Recipients) == 0 {
+			bounce.Recipients = []*BounceRecipient{{Recipient: recipient, Action: ActionFailed}}
+		} else if len(bounce.Recipients) == 1 && bounce.Recipients[0].Recipient == "" {
+			bounce.Recipients[0].Recipient = recipient
+		}
+	}
+	if len(bounce.Recipients) == 0 {
+		return nil, errors.New("no recipients found in bounce")
+	}
+	return bounce, nil
+}
+
+func (b *Bounce) parsePart(header textproto.MIMEHeader, body io.Reader, texts *[][]byte) error {
+	body = mimeutil.DecodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body)
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return errors.Wrap(err, "reading bounce part failed")
+			}
+			err = b.parsePart(part.Header, part, texts)
+			if err != nil {
+				return err
+			}
+		}
+	case mediaType == "message/delivery-status" || mediaType == "message/global-delivery-status":
+		recipients, err := parseDeliveryStatus(body)
+		if err != nil {
+			return err
+		}
+		b.Standard = true
+		b.Recipients = append(b.Recipients, recipients...)
+	case mediaType == "message/rfc822" || mediaType == "text/rfc822-headers" || mediaType == "message/global":
+		original, err := textproto.NewReader(bufio.NewReader(body)).ReadMIMEHeader()
+		if err != nil && len(original) == 0 {
+			return nil
+		}
+		if b.MessageID == "" {
+			b.MessageID = strings.TrimSpace(original.Get("Message-Id"))
+		}
+	case strings.HasPrefix(mediaType, "text/"):
+		text, err := ioutil.ReadAll(body)
+		if err != nil {
+			return errors.Wrap(err, "reading bounce text failed")
+		}
+		*texts = append(*texts, text)
+	}
+	return nil
+}
+
+// parseDeliveryStatus parses the per-message and per-recipient field groups of a message/delivery-status part
+func parseDeliveryStatus(body io.Reader) ([]*BounceRecipient, error) {
+	reader := textproto.NewReader(bufio.NewReader(body))
+	var recipients []*BounceRecipient
+	first := true
+	for {
+		fields, err := reader.ReadMIMEHeader()
+		if len(fields) > 0 {
+			if first {
+				first = false
+				if fields.Get("Final-Recipient") == "" && fields.Get("Original-Recipient") == "" {
+					continue
+				}
+			}
+			recipient := &BounceRecipient{
+				Recipient:  typedValue(fields.Get("Final-Recipient")),
+				Action:     strings.ToLower(strings.TrimSpace(fields.Get("Action"))),
+				Status:     strings.TrimSpace(fields.Get("Status")),
+				RemoteMTA:  typedValue(fields.Get("Remote-MTA")),
+				Diagnostic: typedValue(fields.Get("Diagnostic-Code")),
+			}
+			if recipient.Recipient == "" {
+				recipient.Recipient = typedValue(fields.Get("Original-Recipient"))
+			}
+			if i := strings.IndexByte(recipient.Status, ' '); i >= 0 {
+				recipient.Status = recipient.Status[:i]
+			}
+			recipients = append(recipients, recipient)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing delivery status failed")
+		}
+	}
+	return recipients, nil
+}
+
+// typedValue strips the type prefix of DSN fields such as "rfc822; someuser@somedomain.com"
+func typedValue(value string) string {
+	if i := strings.IndexByte(value, ';'); i >= 0 {
+		value = value[i+1:]
+	}
+	return strings.Trim(strings.TrimSpace(value), "<>")
+}
+
+var (
+	messageIDPattern     = regexp.MustCompile(`(?im)^Message-ID:\s*(<[^>\s]+>)`)
+	bounceAddrPattern    = regexp.MustCompile(`<?([A-Za-z0-9.!#$%&'*+/=?^_{|}~-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)+)>?`)
+	bounceStatusPattern  = regexp.MustCompile(`\b([245])\.(\d{1,3})\.(\d{1,3})\b`)
+	bounceReplyPattern   = regexp.MustCompile(`(?:^|:\s*)([245]\d\d)[ -]`)
+	bounceDelayedPattern = regexp.MustCompile(`(?i)\b(delayed|will (?:continue to )?retry|not yet been delivered)\b`)
+	bounceHeaderPattern  = regexp.MustCompile(`(?i)^\s*(from|to|cc|reply-to|return-path|sender|message-id|in-reply-to|references):`)
+)
+
+// parseBounceText extracts the recipients of non-standard bounces such as the ones generated by qmail and Exim
+// Each address found in the text followed by an SMTP reply is considered as a recipient
+func parseBounceText(texts [][]byte) []*BounceRecipient {
+	var recipients []*BounceRecipient
+	seen := map[string]*BounceRecipient{}
+	for _, text := range texts {
+		delayed := bounceDelayedPattern.Match(text)
+		var current *BounceRecipient
+		scanner := bufio.NewScanner(bytes.NewReader(text))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if bounceHeaderPattern.MatchString(line) {
+				// Included headers of the original mail are not recipients
+				current = nil
+				continue
+			}
+			trimmed := strings.TrimSpace(line)
+			reply := bounceReplyPattern.FindStringSubmatch(trimmed + " ")
+			if match := bounceAddrPattern.FindStringSubmatch(line); match != nil && (reply == nil || current == nil) {
+				addr := strings.ToLower(match[1])
+				if recipient, ok := seen[addr]; ok {
+					current = recipient
+				} else {
+					current = &BounceRecipient{Recipient: match[1]}
+					seen[addr] = current
+				}
+			}
+			if current == nil {
+				continue
+			}
+			if current.Status == "" {
+				current.Status = bounceStatusPattern.FindString(trimmed)
+			}
+			if reply != nil && current.Diagnostic == "" {
+				current.Diagnostic = trimmed
+				if current.Status == "" {
+					current.Status = reply[1][:1] + ".0.0"
+				}
+				recipients = append(recipients, current)
+			}
+		}
+		for _, recipient := range recipients {
+			if recipient.Action != "" {
+				continue
+			}
+			switch {
+			case strings.HasPrefix(recipient.Status, "4") || delayed:
+				recipient.Action = ActionDelayed
+			case strings.HasPrefix(recipient.Status, "2"):
+				recipient.Action = ActionDelivered
+			default:
+				recipient.Action = ActionFailed
+			}
+		}
+	}
+	return recipients
+}
@@ -0,0 +1,131 @@
+package ms
+
+import (
+	"bytes"
+	"github.com/cevatbarisyilmaz/ms/smtp"
+	"strings"
+	"testing"
+)
+
+func TestParseBounce_DSN(t *testing.T) {
+	m := &Mail{
+		Headers: map[string][]byte{
+			"From":       []byte("sender@example.org"),
+			"To":         []byte("a@example.com"),
+			"Message-ID": []byte("<1.2.3@example.org>"),
+		},
+		Body: []byte("Hi!"),
+	}
+	report := &Report{
+		Recipients: map[string]*Result{
+			"a@example.com": {
+				Recipient: "a@example.com",
+				Status:    Failed,
+				MX:        "mx.example.com",
+				Err: &smtp.SMTPError{
+					Code:         550,
+					EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+					Message:      "No such user",
+				},
+			},
+		},
+	}
+	dsn, err := NewDSN("example.org", "sender@example.org", m, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bounce, err := ParseBounce(bytes.NewReader(dsn.encode()), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bounce.Standard {
+		t.Error("DSN is not recognized as standard")
+	}
+	if bounce.MessageID != "<1.2.3@example.org>" {
+		t.Error("Invalid Message-ID:", bounce.MessageID)
+	}
+	if len(bounce.Recipients) != 1 {
+		t.Fatal("Invalid number of recipients:", len(bounce.Recipients))
+	}
+	recipient := bounce.Recipients[0]
+	if recipient.Recipient != "a@example.com" || recipient.Action != ActionFailed || recipient.Status != "5.1.1" ||
+		recipient.RemoteMTA != "mx.example.com" || recipient.Diagnostic != "550 5.1.1 No such user" {
+		t.Errorf("Invalid recipient: %+v", recipient)
+	}
+}
+
+func TestParseBounce_Exim(t *testing.T) {
+	raw := strings.Replace(`From: Mail Delivery System <Mailer-Daemon@example.com>
+To: bounces+joe=example.net@example.org
+Subject: Mail delivery failed: returning message to sender
+
+This message was created automatically by mail delivery software.
+
+A message that you sent could not be delivered to one or more of its
+recipients. This is a permanent error. The following address(es) failed:
+
+  joe@example.net
+    host mx.example.net [192.0.2.1]
+    SMTP error from remote mail server after RCPT TO:<joe@example.net>:
+    550 5.1.1 <joe@example.net>: Recipient address rejected
+
+------ This is a copy of the message, including all the headers. ------
+
+Message-ID: <4.5.6@example.org>
+From: sender@example.org
+To: joe@example.net
+
+Hello
+`, "\n", "\r\n", -1)
+	bounce, err := ParseBounce(strings.NewReader(raw), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bounce.Standard {
+		t.Error("Exim bounce is recognized as standard")
+	}
+	if bounce.MessageID != "<4.5.6@example.org>" {
+		t.Error("Invalid Message-ID:", bounce.MessageID)
+	}
+	if len(bounce.Recipients) != 1 {
+		t.Fatal("Invalid number of recipients:", len(bounce.Recipients))
+	}
+	recipient := bounce.Recipients[0]
+	if recipient.Recipient != "joe@example.net" || recipient.Action != ActionFailed || recipient.Status != "5.1.1" {
+		t.Errorf("Invalid recipient: %+v", recipient)
+	}
+}
+
+func TestParseBounce_VERP(t *testing.T) {
+	raw := "From: postmaster@example.net\r\nSubject: Undeliverable\r\n\r\nYour message could not be delivered.\r\n"
+	bounce, err := ParseBounce(strings.NewReader(raw), VERP("bounces@example.org", "joe@example.net"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bounce.Recipients) != 1 || bounce.Recipients[0].Recipient != "joe@example.net" {
+		t.Errorf("Invalid recipients: %+v", bounce.Recipients)
+	}
+}
+
+func TestVERP(t *testing.T) {
+	addr := VERP("bounces@example.org", "joe+tag@example.net")
+	if addr != "bounces+joe+tag=example.net@example.org" {
+		t.Fatal("Invalid VERP address:", addr)
+	}
+	sender, recipient, ok := DecodeVERP(addr)
+	if !ok || sender != "bounces@example.org" || recipient != "joe+tag@example.net" {
+		t.Error("Invalid decoding:", sender, recipient, ok)
+	}
+	if _, _, ok := DecodeVERP("bounces@example.org"); ok {
+		t.Error("Plain address is decoded as VERP")
+	}
+
+	// The sender with a + couldn't be told apart from the recipient
+	addr = VERP("bounces+news@example.org", "joe@example.com")
+	if addr != "bounces+news@example.org" {
+		t.Error("Sender with + is encoded:", addr)
+	}
+	if sender, recipient, ok := DecodeVERP(addr); ok {
+		t.Error("Sender with + is decoded:", sender, recipient)
+	}
+}
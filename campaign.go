@@ -0,0 +1,218 @@
+package ms
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"sync"
+)
+
+// Campaign sends an individual mail to each of many recipients such as the subscribers of a newsletter
+// Each mail has its own To header, Message-ID and DKIM signature, so the recipients don't see each other
+// The mails are rendered and sent one by one, a stopped campaign continues where it stopped when it is run again
+type Campaign struct {
+	// Concurrency is the number of mails sent at the same time, 1 is used if it is 0
+	Concurrency int
+
+	s          *Service
+	render     func(recipient *Recipient) (*Mail, error)
+	recipients []*Recipient
+
+	mu      sync.Mutex
+	running bool
+	next    int
+	reports []*Report
+}
+
+// Progress is the state of a campaign
+type Progress struct {
+	// Total is the number of the recipients
+	Total int
+	// Next is the index of the first recipient that isn't sent yet, see Campaign.Seek
+	Next int
+	// Sent is the number of the recipients that are sent, including the failed ones
+	Sent       int
+	Delivered  int
+	Deferred   int
+	Failed     int
+	Suppressed int
+}
+
+// Done reports whether all recipients are sent
+func (p Progress) Done() bool {
+	return p.Sent == p.Total
+}
+
+// NewCampaign returns a campaign sending a copy of the base mail to each recipient
+// The To header of each copy is the address of the recipient, the Cc and Bcc headers of the base mail are dropped
+// The data of the recipients is not used
+func (s *Service) NewCampaign(base *Mail, recipients []*Recipient) *Campaign {
+	return s.newCampaign(recipients, func(recipient *Recipient) (*Mail, error) {
+		m := base.clone()
+		delete(m.Headers, "Cc")
+		delete(m.Headers, "Bcc")
+		delete(m.Headers, "Message-ID")
+		m.Headers["To"] = []byte(recipient.Address)
+		return m, nil
+	})
+}
+
+// NewTemplateCampaign returns a campaign sending the template rendered with the data of each recipient
+// The mails of all recipients are rendered once before returning, so errors such as missing variables
+// are reported before any delivery is attempted
+func (s *Service) NewTemplateCampaign(from string, t *Template, recipients []*Recipient) (*Campaign, error) {
+	for _, recipient := range recipients {
+		_, err := t.Render(from, recipient.Address, recipient.Data)
+		if err != nil {
+			return nil, errors.Wrap(err, "rendering mail to "+recipient.Address+" failed")
+		}
+	}
+	return s.newCampaign(recipients, func(recipient *Recipient) (*Mail, error) {
+		return t.Render(from, recipient.Address, recipient.Data)
+	}), nil
+}
+
+func (s *Service) newCampaign(recipients []*Recipient, render func(recipient *Recipient) (*Mail, error)) *Campaign {
+	return &Campaign{
+		s:          s,
+		render:     render,
+		recipients: recipients,
+		reports:    make([]*Report, len(recipients)),
+	}
+}
+
+// Run sends the mails to the recipients that aren't sent yet
+// It returns when all recipients are sent or the context is done, the mails being sent are completed before returning
+// It returns the error of the context if the campaign is stopped before all recipients are sent
+func (c *Campaign) Run(ctx context.Context) error {
+	c.mu.Lock()
+	if c.running {
+		c.mu.Unlock()
+		return errors.New("campaign is already running")
+	}
+	c.running = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.running = false
+		c.mu.Unlock()
+	}()
+
+	concurrency := c.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				index, ok := c.take()
+				if !ok {
+					return
+				}
+				c.complete(index, c.send(c.recipients[index]))
+			}
+		}()
+	}
+	wg.Wait()
+	if !c.Progress().Done() {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// take returns the index of the next recipient to send
+func (c *Campaign) take() (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.next < len(c.recipients) {
+		index := c.next
+		c.next++
+		if c.reports[index] == nil {
+			return index, true
+		}
+	}
+	return 0, false
+}
+
+func (c *Campaign) complete(index int, report *Report) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reports[index] = report
+}
+
+// send delivers the mail of the recipient, the failures are recorded in the report
+func (c *Campaign) send(recipient *Recipient) *Report {
+	m, err := c.render(recipient)
+	if err == nil {
+		var report *Report
+		report, err = c.s.Deliver(m)
+		if err == nil {
+			return report
+		}
+	}
+	return &Report{
+		Recipients: map[string]*Result{
+			recipient.Address: {Recipient: recipient.Address, Status: Failed, Err: err},
+		},
+	}
+}
+
+// Seek makes the campaign continue from the recipient at the index, such as the Next of a saved Progress
+// after a restart
+// The recipients before the index are skipped as if they were sent already, their reports have no results
+// The index is clamped to the recipients, so a negative index starts from the first recipient
+func (c *Campaign) Seek(index int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if index < 0 {
+		index = 0
+	}
+	if index > len(c.recipients) {
+		index = len(c.recipients)
+	}
+	for i := 0; i < index; i++ {
+		if c.reports[i] == nil {
+			c.reports[i] = &Report{Recipients: map[string]*Result{}}
+		}
+	}
+	c.next = index
+}
+
+// Progress returns the current state of the campaign
+func (c *Campaign) Progress() Progress {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	progress := Progress{Total: len(c.recipients), Next: len(c.recipients)}
+	for i, report := range c.reports {
+		if report == nil {
+			if i < progress.Next {
+				progress.Next = i
+			}
+			continue
+		}
+		progress.Sent++
+		for _, result := range report.Recipients {
+			switch result.Status {
+			case Delivered:
+				progress.Delivered++
+			case Deferred:
+				progress.Deferred++
+			case Failed:
+				progress.Failed++
+			case Suppressed:
+				progress.Suppressed++
+			}
+		}
+	}
+	return progress
+}
+
+// Reports returns the reports of the mails in the order of the recipients
+// The reports of the recipients that aren't sent yet are nil, the ones of the recipients skipped by Seek have no results
+func (c *Campaign) Reports() []*Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*Report(nil), c.reports...)
+}
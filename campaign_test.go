@@ -0,0 +1,138 @@
+package ms
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCampaign(t *testing.T) {
+	transport := &MemoryTransport{}
+	s := newTestService(t)
+	s.Transport = transport
+	s.Suppressions = NewMemorySuppressionStore()
+	err := s.Suppressions.Add(&Suppression{Recipient: "bob@example.com", Reason: SuppressionManual})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := &Mail{
+		Headers: map[string][]byte{
+			"From":    []byte("news@example.org"),
+			"To":      []byte("everyone@example.org"),
+			"Bcc":     []byte("archive@example.org"),
+			"Subject": []byte("News"),
+		},
+		Body: []byte("News"),
+	}
+	recipients := []*Recipient{
+		{Address: "joe@example.com"},
+		{Address: "jane@example.com"},
+		{Address: "bob@example.com"},
+		{Address: "invalid"},
+	}
+	campaign := s.NewCampaign(base, recipients)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = campaign.Run(ctx); err != context.Canceled {
+		t.Fatal("Cancelled campaign didn't stop:", err)
+	}
+	campaign.Seek(1)
+	err = campaign.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress := campaign.Progress()
+	expected := Progress{Total: 4, Next: 4, Sent: 4, Delivered: 1, Failed: 1, Suppressed: 1}
+	if progress != expected || !progress.Done() {
+		t.Errorf("Invalid progress: %+v", progress)
+	}
+	mails := transport.Mails()
+	if len(mails) != 1 || len(mails[0].Envelope.Recipients) != 1 || mails[0].Envelope.Recipients[0] != "jane@example.com" {
+		t.Fatal("Invalid mails:", mails)
+	}
+	data := string(mails[0].Data)
+	if !strings.Contains(data, "To: jane@example.com\r\n") || strings.Contains(data, "everyone@example.org") || strings.Contains(data, "archive@example.org") {
+		t.Errorf("Mail is not personalized: %q", data)
+	}
+	if _, ok := base.Headers["Message-ID"]; ok || string(base.Headers["To"]) != "everyone@example.org" {
+		t.Error("Base mail is modified")
+	}
+	reports := campaign.Reports()
+	if reports[1].MessageID == "" || reports[3].Recipients["invalid"].Status != Failed {
+		t.Error("Invalid reports:", reports)
+	}
+}
+
+func TestCampaign_Seek(t *testing.T) {
+	transport := &MemoryTransport{}
+	s := newTestService(t)
+	s.Transport = transport
+	campaign := s.NewCampaign(&Mail{
+		Headers: map[string][]byte{
+			"From": []byte("news@example.org"),
+		},
+		Body: []byte("News"),
+	}, []*Recipient{
+		{Address: "joe@example.com"},
+		{Address: "jane@example.com"},
+	})
+	campaign.Seek(-1)
+	if progress := campaign.Progress(); progress.Next != 0 || progress.Sent != 0 {
+		t.Errorf("Invalid progress after seeking to a negative index: %+v", progress)
+	}
+	err := campaign.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transport.Mails()) != 2 {
+		t.Error("Invalid mails:", transport.Mails())
+	}
+	campaign.Seek(10)
+	if progress := campaign.Progress(); progress.Next != 2 || !progress.Done() {
+		t.Errorf("Invalid progress after seeking past the end: %+v", progress)
+	}
+
+	campaign = s.NewCampaign(&Mail{
+		Headers: map[string][]byte{
+			"From": []byte("news@example.org"),
+		},
+		Body: []byte("News"),
+	}, []*Recipient{
+		{Address: "joe@example.com"},
+		{Address: "jane@example.com"},
+	})
+	campaign.Seek(1)
+	reports := campaign.Reports()
+	if reports[0] == nil || len(reports[0].Recipients) != 0 || reports[1] != nil {
+		t.Error("Invalid reports after seeking:", reports)
+	}
+}
+
+func TestTemplateCampaign(t *testing.T) {
+	transport := &MemoryTransport{}
+	s := newTestService(t)
+	s.Transport = transport
+	tmpl, err := NewTemplate("Hello {{.}}", "Hello {{.}}", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	campaign, err := s.NewTemplateCampaign("news@example.org", tmpl, []*Recipient{
+		{Address: "joe@example.com", Data: "Joe"},
+		{Address: "jane@example.com", Data: "Jane"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	campaign.Concurrency = 2
+	err = campaign.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transport.Mails()) != 2 || campaign.Progress().Delivered != 2 {
+		t.Error("Mails are not sent:", campaign.Progress())
+	}
+	reports := campaign.Reports()
+	if reports[0].MessageID == reports[1].MessageID {
+		t.Error("Mails share the Message-ID")
+	}
+}
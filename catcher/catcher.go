@@ -0,0 +1,107 @@
+// Package catcher implements a mail catcher for staging environments
+//
+// A Catcher accepts every mail sent to its SMTP server without delivering it
+// and serves the caught mails through an HTTP/JSON API and a simple web view:
+//
+//	GET    /api/messages?q=query     lists the mails, optionally the ones matching the query
+//	GET    /api/messages/{id}        returns the envelope, headers and MIME parts of a mail
+//	GET    /api/messages/{id}/raw    returns the raw source of a mail
+//	GET    /api/messages/{id}/parts/{n}  returns the decoded content of a MIME part
+//	DELETE /api/messages/{id}        deletes a mail
+//	DELETE /api/messages             deletes all mails
+//
+// Services can be pointed at the catcher with ms.RelayTransport.
+package catcher
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/cevatbarisyilmaz/ms/smtp"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// Catcher accepts all mails sent to it and keeps them in its store
+type Catcher struct {
+	Store Store
+	// SMTP is the server accepting the mails, it can be configured before serving
+	SMTP *smtp.Server
+}
+
+// New returns a Catcher keeping the mails in the store
+func New(store Store) *Catcher {
+	c := &Catcher{Store: store}
+	c.SMTP = smtp.NewServer(&backend{c: c})
+	c.SMTP.Domain = "localhost"
+	c.SMTP.AllowInsecureAuth = true
+	c.SMTP.EnableSMTPUTF8 = true
+	return c
+}
+
+func (c *Catcher) catch(from string, to []string, raw []byte) error {
+	id := make([]byte, 12)
+	_, err := rand.Read(id)
+	if err != nil {
+		return err
+	}
+	return c.Store.Add(newMessage(hex.EncodeToString(id), from, to, raw, time.Now()))
+}
+
+// backend accepts any credentials and any mail
+type backend struct {
+	c *Catcher
+}
+
+func (b *backend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	return &session{c: b.c}, nil
+}
+
+func (b *backend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	return &session{c: b.c}, nil
+}
+
+type session struct {
+	c    *Catcher
+	from string
+	to   []string
+}
+
+func (s *session) Reset() {
+	s.from = ""
+	s.to = nil
+}
+
+func (s *session) Logout() error {
+	return nil
+}
+
+func (s *session) Mail(from string, opts smtp.MailOptions) error {
+	s.from = from
+	return nil
+}
+
+func (s *session) Rcpt(to string) error {
+	s.to = append(s.to, to)
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return s.c.catch(s.from, s.to, toCRLF(data))
+}
+
+// toCRLF restores the line endings converted to LF while reading the data
+func toCRLF(data []byte) []byte {
+	raw := make([]byte, 0, len(data))
+	for _, b := range data {
+		if b == '\n' {
+			raw = append(raw, '\r')
+		}
+		raw = append(raw, b)
+	}
+	return raw
+}
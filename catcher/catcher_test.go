@@ -0,0 +1,155 @@
+package catcher
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cevatbarisyilmaz/ms/smtp"
+)
+
+const testMail = "From: joe@example.org\r\n" +
+	"To: jane@example.com\r\n" +
+	"Subject: =?utf-8?q?Hello_W=C3=B6rld?=\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/alternative; boundary=b\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Your code is 1234\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"PHA+WW91ciBjb2RlIGlzIDEyMzQ8L3A+\r\n" +
+	"--b--\r\n"
+
+func TestCatcher(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("cannot listen on loopback:", err)
+	}
+	c := New(NewMemoryStore())
+	go c.SMTP.Serve(l)
+	defer c.SMTP.Close()
+	err = smtp.SendMail(l.Addr().String(), nil, "joe@example.org", []string{"jane@example.com"}, strings.NewReader(testMail), "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+	var summaries []*summary
+	getJSON(t, srv.URL+"/api/messages?q=code+is", &summaries)
+	if len(summaries) != 1 || summaries[0].Subject != "Hello Wörld" || summaries[0].To[0] != "jane@example.com" {
+		t.Fatalf("Invalid list: %+v", summaries)
+	}
+	getJSON(t, srv.URL+"/api/messages?q=nothing", &summaries)
+	if len(summaries) != 0 {
+		t.Fatalf("Search matched: %+v", summaries)
+	}
+
+	id := firstID(t, srv.URL)
+	var m Message
+	getJSON(t, srv.URL+"/api/messages/"+id, &m)
+	if m.From != "joe@example.org" || len(m.Parts) != 2 || m.Parts[1].Body != "<p>Your code is 1234</p>" {
+		t.Fatalf("Invalid message: %+v", m)
+	}
+	if body := get(t, srv.URL+"/api/messages/"+id+"/raw"); body != testMail {
+		t.Errorf("Invalid raw source: %q", body)
+	}
+	if body := get(t, srv.URL+"/messages/"+id); !strings.Contains(body, "Hello Wörld") {
+		t.Error("Web view doesn't show the mail")
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/api/messages/"+id, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatal("Deleting failed:", resp, err)
+	}
+	resp.Body.Close()
+	getJSON(t, srv.URL+"/api/messages", &summaries)
+	if len(summaries) != 0 {
+		t.Fatalf("Mail is not deleted: %+v", summaries)
+	}
+}
+
+func TestDirStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	err = store.Add(newMessage("0a", "joe@example.org", []string{"jane@example.com"}, []byte(testMail), received))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Add(newMessage("0b", "joe@example.org", []string{"bob@example.com"}, []byte(testMail), received.Add(time.Second)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Add(&Message{ID: "../escape"}); err == nil {
+		t.Error("Invalid ID is accepted")
+	}
+	list, err := store.List()
+	if err != nil || len(list) != 2 || list[0].ID != "0b" || !list[1].Received.Equal(received) || len(list[1].Parts) != 2 {
+		t.Fatal("Invalid list:", list, err)
+	}
+	err = store.Delete("0b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := store.Get("0b")
+	if err != nil || m != nil {
+		t.Fatal("Deleted mail is returned:", m, err)
+	}
+	err = store.DeleteAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err = store.List()
+	if err != nil || len(list) != 0 {
+		t.Fatal("Mails are not deleted:", list, err)
+	}
+}
+
+func firstID(t *testing.T, url string) string {
+	var summaries []*summary
+	getJSON(t, url+"/api/messages", &summaries)
+	if len(summaries) == 0 {
+		t.Fatal("No mails")
+	}
+	return summaries[0].ID
+}
+
+func get(t *testing.T, url string) string {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("Request failed:", url, resp.Status, err)
+	}
+	return string(body)
+}
+
+func getJSON(t *testing.T, url string, v interface{}) {
+	err := json.Unmarshal([]byte(get(t, url)), v)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
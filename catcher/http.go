@@ -0,0 +1,242 @@
+package catcher
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// summary is the listing entry of a mail
+type summary struct {
+	ID       string
+	From     string
+	To       []string
+	Received time.Time
+	Size     int
+	Subject  string
+}
+
+func summarize(m *Message) *summary {
+	return &summary{
+		ID:       m.ID,
+		From:     m.From,
+		To:       m.To,
+		Received: m.Received,
+		Size:     m.Size,
+		Subject:  m.Subject,
+	}
+}
+
+// ServeHTTP serves the API and the web view of the caught mails
+func (c *Catcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "":
+		c.serveIndex(w, r)
+	case strings.HasPrefix(path, "messages/"):
+		c.serveView(w, r, strings.TrimPrefix(path, "messages/"))
+	case path == "api/messages":
+		c.serveMessages(w, r)
+	case strings.HasPrefix(path, "api/messages/"):
+		c.serveMessage(w, r, strings.Split(strings.TrimPrefix(path, "api/messages/"), "/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// list returns the mails matching the query of the request
+func (c *Catcher) list(r *http.Request) ([]*Message, error) {
+	list, err := c.Store.List()
+	if err != nil {
+		return nil, err
+	}
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		return list, nil
+	}
+	var matches []*Message
+	for _, m := range list {
+		if m.matches(query) {
+			matches = append(matches, m)
+		}
+	}
+	return matches, nil
+}
+
+func (c *Catcher) serveMessages(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list, err := c.list(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		summaries := make([]*summary, 0, len(list))
+		for _, m := range list {
+			summaries = append(summaries, summarize(m))
+		}
+		writeJSON(w, summaries)
+	case http.MethodDelete:
+		err := c.Store.DeleteAll()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *Catcher) serveMessage(w http.ResponseWriter, r *http.Request, path []string) {
+	m, err := c.Store.Get(path[0])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if m == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodDelete && len(path) == 1 {
+		err = c.Store.Delete(m.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch {
+	case len(path) == 1:
+		writeJSON(w, m)
+	case len(path) == 2 && path[1] == "raw":
+		w.Header().Set("Content-Type", "message/rfc822")
+		w.Write(m.Raw)
+	case len(path) == 3 && path[1] == "parts":
+		n, err := strconv.Atoi(path[2])
+		if err != nil || n < 0 || n >= len(m.Parts) {
+			http.NotFound(w, r)
+			return
+		}
+		part := m.Parts[n]
+		contentType := part.ContentType
+		if charset := part.charset(); charset != "" {
+			contentType += "; charset=" + charset
+		}
+		w.Header().Set("Content-Type", contentType)
+		// The parts are untrusted content, scripts of HTML parts must not run in the origin of the catcher
+		w.Header().Set("Content-Security-Policy", "sandbox")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Write(part.data)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (p *Part) charset() string {
+	contentType := p.Headers["Content-Type"]
+	if len(contentType) == 0 {
+		return ""
+	}
+	for _, param := range strings.Split(contentType[0], ";")[1:] {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], "charset") {
+			return strings.Trim(kv[1], `"`)
+		}
+	}
+	return ""
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func (c *Catcher) serveIndex(w http.ResponseWriter, r *http.Request) {
+	list, err := c.list(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	indexTemplate.Execute(w, struct {
+		Query    string
+		Messages []*Message
+	}{r.URL.Query().Get("q"), list})
+}
+
+func (c *Catcher) serveView(w http.ResponseWriter, r *http.Request, id string) {
+	m, err := c.Store.Get(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if m == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	viewTemplate.Execute(w, m)
+}
+
+const style = `<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+td, th { border-bottom: 1px solid #ddd; padding: .4em; text-align: left; vertical-align: top; }
+pre { white-space: pre-wrap; background: #f6f6f6; padding: 1em; }
+iframe { width: 100%; height: 30em; border: 1px solid #ddd; }
+</style>`
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Mail Catcher</title>` + style + `</head>
+<body>
+<h1>Mail Catcher</h1>
+<form method="get" action="/"><input name="q" value="{{.Query}}" placeholder="Search"> <button>Search</button></form>
+<table>
+<tr><th>Received</th><th>From</th><th>To</th><th>Subject</th><th>Size</th></tr>
+{{range .Messages}}<tr>
+<td>{{.Received.Format "2006-01-02 15:04:05"}}</td>
+<td>{{.From}}</td>
+<td>{{range $i, $to := .To}}{{if $i}}, {{end}}{{$to}}{{end}}</td>
+<td><a href="/messages/{{.ID}}">{{if .Subject}}{{.Subject}}{{else}}(no subject){{end}}</a></td>
+<td>{{.Size}}</td>
+</tr>{{else}}<tr><td colspan="5">No mails</td></tr>{{end}}
+</table>
+</body>
+</html>
+`))
+
+var viewTemplate = template.Must(template.New("view").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Subject}}</title>` + style + `</head>
+<body>
+<p><a href="/">All mails</a> | <a href="/api/messages/{{.ID}}/raw">Raw source</a></p>
+<h1>{{if .Subject}}{{.Subject}}{{else}}(no subject){{end}}</h1>
+<table>
+<tr><th>Envelope From</th><td>{{.From}}</td></tr>
+<tr><th>Envelope To</th><td>{{range $i, $to := .To}}{{if $i}}, {{end}}{{$to}}{{end}}</td></tr>
+<tr><th>Received</th><td>{{.Received.Format "2006-01-02 15:04:05"}}</td></tr>
+{{range $key, $values := .Headers}}{{range $values}}<tr><th>{{$key}}</th><td>{{.}}</td></tr>{{end}}{{end}}
+</table>
+{{$id := .ID}}{{range $i, $part := .Parts}}
+<h2>{{$part.ContentType}}{{if $part.Filename}} ({{$part.Filename}}){{end}}</h2>
+{{if eq $part.ContentType "text/html"}}<iframe sandbox src="/api/messages/{{$id}}/parts/{{$i}}"></iframe>
+{{else if $part.Body}}<pre>{{$part.Body}}</pre>
+{{else}}<p><a href="/api/messages/{{$id}}/parts/{{$i}}">Download</a> ({{$part.Size}} bytes)</p>{{end}}
+{{end}}
+</body>
+</html>
+`))
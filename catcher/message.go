@@ -0,0 +1,133 @@
+package catcher
+
+import (
+	"bytes"
+	"github.com/cevatbarisyilmaz/ms/internal/mimeutil"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Message is a mail caught by the catcher
+type Message struct {
+	ID       string
+	From     string
+	To       []string
+	Received time.Time
+	Size     int
+	Subject  string
+	Headers  map[string][]string
+	// Parts are the leaf MIME parts of the mail in order
+	Parts []*Part
+	// Raw is the mail as received
+	Raw []byte `json:"-"`
+}
+
+// Part is a leaf MIME part of a mail
+type Part struct {
+	ContentType string
+	Filename    string `json:",omitempty"`
+	Headers     map[string][]string
+	Size        int
+	// Body is the decoded content of textual parts
+	Body string `json:",omitempty"`
+	// data is the decoded content of the part
+	data []byte
+}
+
+// newMessage parses the raw mail into a Message
+// Malformed mails are kept with their raw source only
+func newMessage(id string, from string, to []string, raw []byte, received time.Time) *Message {
+	m := &Message{
+		ID:       id,
+		From:     from,
+		To:       to,
+		Received: received,
+		Size:     len(raw),
+		Raw:      raw,
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return m
+	}
+	m.Headers = msg.Header
+	m.Subject = decodeHeader(msg.Header.Get("Subject"))
+	m.Parts, _ = parseParts(textproto.MIMEHeader(msg.Header), msg.Body)
+	return m
+}
+
+// parseParts returns the leaf parts of the MIME entity
+func parseParts(header textproto.MIMEHeader, body io.Reader) ([]*Part, error) {
+	body = mimeutil.DecodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body)
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+		params = map[string]string{}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		var parts []*Part
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := reader.NextPart()
+			if err == io.EOF {
+				return parts, nil
+			}
+			if err != nil {
+				return parts, err
+			}
+			children, err := parseParts(p.Header, p)
+			parts = append(parts, children...)
+			if err != nil {
+				return parts, err
+			}
+		}
+	}
+	data, err := ioutil.ReadAll(body)
+	part := &Part{
+		ContentType: mediaType,
+		Headers:     header,
+		Size:        len(data),
+		data:        data,
+	}
+	if _, dispositionParams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		part.Filename = decodeHeader(dispositionParams["filename"])
+	}
+	if part.Filename == "" {
+		part.Filename = decodeHeader(params["name"])
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		part.Body = string(data)
+	}
+	return []*Part{part}, err
+}
+
+var wordDecoder = &mime.WordDecoder{}
+
+// decodeHeader decodes the encoded words (RFC 2047) of the header value
+func decodeHeader(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// matches reports whether the query is found in the envelope, the subject or the textual parts of the mail
+func (m *Message) matches(query string) bool {
+	query = strings.ToLower(query)
+	fields := append([]string{m.From, m.Subject}, m.To...)
+	for _, part := range m.Parts {
+		fields = append(fields, part.Body)
+	}
+	for _, field := range fields {
+		if strings.Contains(strings.ToLower(field), query) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,242 @@
+package catcher
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store keeps the caught mails
+type Store interface {
+	// Add keeps the mail
+	Add(m *Message) error
+	// Get returns the mail with the ID, it returns nil if there is no such mail
+	Get(id string) (*Message, error)
+	// List returns all mails starting with the latest one
+	List() ([]*Message, error)
+	// Delete discards the mail with the ID
+	Delete(id string) error
+	// DeleteAll discards all mails
+	DeleteAll() error
+}
+
+// MemoryStore is a Store that keeps the mails in memory
+type MemoryStore struct {
+	// Limit is the maximum number of mails to keep, the oldest ones are discarded first
+	// 0 means no limit
+	Limit int
+
+	mu       sync.Mutex
+	messages []*Message
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+// Add keeps the mail
+func (s *MemoryStore) Add(m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, m)
+	if s.Limit > 0 && len(s.messages) > s.Limit {
+		s.messages = append([]*Message(nil), s.messages[len(s.messages)-s.Limit:]...)
+	}
+	return nil
+}
+
+// Get returns the mail with the ID
+func (s *MemoryStore) Get(id string) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.messages {
+		if m.ID == id {
+			return m, nil
+		}
+	}
+	return nil, nil
+}
+
+// List returns all mails starting with the latest one
+func (s *MemoryStore) List() ([]*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*Message, 0, len(s.messages))
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		list = append(list, s.messages[i])
+	}
+	return list, nil
+}
+
+// Delete discards the mail with the ID
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, m := range s.messages {
+		if m.ID == id {
+			s.messages = append(s.messages[:i], s.messages[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// DeleteAll discards all mails
+func (s *MemoryStore) DeleteAll() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = nil
+	return nil
+}
+
+// envelope is the metadata of a mail kept by DirStore
+type envelope struct {
+	From     string
+	To       []string
+	Received time.Time
+}
+
+// validID matches the IDs generated by the catcher, so the IDs can't escape the directory
+var validID = regexp.MustCompile(`^[0-9a-f]+$`)
+
+// DirStore is a Store that keeps each mail in a directory as an .eml file
+// with a .json file holding its envelope next to it
+type DirStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewDirStore returns a DirStore keeping the mails in the directory, the directory is created if it doesn't exist
+func NewDirStore(dir string) (*DirStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &DirStore{dir: dir}, nil
+}
+
+// Add writes the mail to the directory
+func (s *DirStore) Add(m *Message) error {
+	if !validID.MatchString(m.ID) {
+		return os.ErrInvalid
+	}
+	data, err := json.Marshal(&envelope{From: m.From, To: m.To, Received: m.Received})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = ioutil.WriteFile(filepath.Join(s.dir, m.ID+".eml"), m.Raw, 0644)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(s.dir, m.ID+".json"), data, 0644)
+}
+
+// Get reads the mail with the ID from the directory
+func (s *DirStore) Get(id string) (*Message, error) {
+	if !validID.MatchString(id) {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read(id)
+}
+
+func (s *DirStore) read(id string) (*Message, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, id+".json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var env envelope
+	err = json.Unmarshal(data, &env)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(s.dir, id+".eml"))
+	if err != nil {
+		return nil, err
+	}
+	return newMessage(id, env.From, env.To, raw, env.Received), nil
+}
+
+// List reads all mails from the directory
+func (s *DirStore) List() ([]*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var list []*Message
+	for _, file := range files {
+		id := strings.TrimSuffix(filepath.Base(file), ".json")
+		if !validID.MatchString(id) {
+			continue
+		}
+		m, err := s.read(id)
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			list = append(list, m)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Received.After(list[j].Received)
+	})
+	return list, nil
+}
+
+// Delete removes the mail with the ID from the directory
+func (s *DirStore) Delete(id string) error {
+	if !validID.MatchString(id) {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remove(id)
+}
+
+func (s *DirStore) remove(id string) error {
+	err := os.Remove(filepath.Join(s.dir, id+".json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(filepath.Join(s.dir, id+".eml"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// DeleteAll removes all mails from the directory
+func (s *DirStore) DeleteAll() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		id := strings.TrimSuffix(filepath.Base(file), ".json")
+		if !validID.MatchString(id) {
+			continue
+		}
+		err = s.remove(id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
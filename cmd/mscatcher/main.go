@@ -0,0 +1,45 @@
+// Command mscatcher runs a mail catcher for staging environments
+//
+// It accepts every mail sent to its SMTP address without delivering it
+// and serves the caught mails on its HTTP address:
+//
+//	mscatcher -smtp :1025 -http :8025 -dir /var/lib/mscatcher
+//
+// See the catcher package for the HTTP API.
+package main
+
+import (
+	"flag"
+	"github.com/cevatbarisyilmaz/ms/catcher"
+	"log"
+	"net/http"
+)
+
+func main() {
+	smtpAddr := flag.String("smtp", ":1025", "address to accept mails on")
+	httpAddr := flag.String("http", ":8025", "address to serve the API and the web view on")
+	dir := flag.String("dir", "", "directory to keep the mails in, they are kept in memory if it is empty")
+	limit := flag.Int("limit", 1000, "maximum number of mails to keep in memory, 0 means no limit")
+	flag.Parse()
+
+	var store catcher.Store
+	if *dir == "" {
+		memoryStore := catcher.NewMemoryStore()
+		memoryStore.Limit = *limit
+		store = memoryStore
+	} else {
+		dirStore, err := catcher.NewDirStore(*dir)
+		if err != nil {
+			log.Fatal("opening mail directory has failed:", err)
+		}
+		store = dirStore
+	}
+	c := catcher.New(store)
+	c.SMTP.Addr = *smtpAddr
+	go func() {
+		log.Println("accepting mails on", *smtpAddr)
+		log.Fatal(c.SMTP.ListenAndServe())
+	}()
+	log.Println("serving mails on", *httpAddr)
+	log.Fatal(http.ListenAndServe(*httpAddr, c))
+}
@@ -0,0 +1,185 @@
+package ms
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// connectionAttemptDelay is the delay between the connection attempts racing each other (RFC 8305)
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// Resolver looks up DNS records, *net.Resolver satisfies it
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// AddressFamily selects the IP versions to connect to the MX hosts with
+type AddressFamily int
+
+const (
+	// AnyFamily uses both IPv6 and IPv4 addresses preferring IPv6 as recommended by RFC 8305
+	AnyFamily AddressFamily = iota
+	// PreferIPv4 uses both IPv4 and IPv6 addresses preferring IPv4
+	PreferIPv4
+	// PreferIPv6 uses both IPv6 and IPv4 addresses preferring IPv6
+	PreferIPv6
+	// OnlyIPv4 uses only IPv4 addresses
+	OnlyIPv4
+	// OnlyIPv6 uses only IPv6 addresses
+	OnlyIPv6
+)
+
+func (s *Service) resolver() Resolver {
+	if s.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return s.Resolver
+}
+
+func (s *Service) family(domain string) AddressFamily {
+	if family, ok := s.Families[strings.ToLower(domain)]; ok {
+		return family
+	}
+	return s.Family
+}
+
+// lookupIP returns the addresses of the MX host allowed for the domain in the order to try
+func (s *Service) lookupIP(domain string, host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	addrs, err := s.resolver().LookupIPAddr(ctx, host)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	ips := sortIPs(addrs, s.family(domain))
+	if len(ips) == 0 {
+		return nil, errors.New("no address of the allowed family found for " + strings.TrimSuffix(host, "."))
+	}
+	return ips, nil
+}
+
+// sortIPs filters the addresses by the family and interleaves IPv6 and IPv4 addresses
+// starting with the preferred family as in Happy Eyeballs (RFC 8305)
+func sortIPs(addrs []net.IPAddr, family AddressFamily) []net.IP {
+	var v4, v6 []net.IP
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			v4 = append(v4, addr.IP)
+		} else {
+			v6 = append(v6, addr.IP)
+		}
+	}
+	switch family {
+	case OnlyIPv4:
+		return v4
+	case OnlyIPv6:
+		return v6
+	}
+	preferred, other := v6, v4
+	if family == PreferIPv4 {
+		preferred, other = v4, v6
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for len(preferred) > 0 || len(other) > 0 {
+		if len(preferred) > 0 {
+			ips = append(ips, preferred[0])
+			preferred = preferred[1:]
+		}
+		if len(other) > 0 {
+			ips = append(ips, other[0])
+			other = other[1:]
+		}
+	}
+	return ips
+}
+
+type dialResult struct {
+	index  int
+	conn   net.Conn
+	source *SourceAddr
+	err    error
+	// elapsed is the duration of the attempt
+	elapsed time.Duration
+}
+
+// dial races connections to the port of the addresses of the MX host as in Happy Eyeballs (RFC 8305)
+// A new attempt is started every connectionAttemptDelay or as soon as the previous one fails
+// It returns the first established connection with its address and source,
+// the failed attempts and the addresses that are not tried yet
+func (s *Service) dial(d *delivery, mx string, ips []net.IP, port string) (net.Conn, net.IP, *SourceAddr, []*Attempt, []net.IP) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	results := make(chan dialResult, len(ips))
+	failed := make([]bool, len(ips))
+	var attempts []*Attempt
+	started, pending := 0, 0
+	start := func() {
+		index := started
+		started++
+		pending++
+		ip := ips[index]
+		source := d.pool.addr(ip)
+		if d.pool != nil && source == nil {
+			results <- dialResult{index: index, err: errors.New("IP pool has no address in the family of " + ip.String())}
+			return
+		}
+		dialer := &net.Dialer{}
+		if source != nil {
+			dialer.LocalAddr = &net.TCPAddr{IP: source.IP}
+		}
+		go func() {
+			begin := time.Now()
+			conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+			results <- dialResult{index: index, conn: conn, source: source, err: err, elapsed: time.Since(begin)}
+		}()
+	}
+	start()
+	for pending > 0 {
+		var delay <-chan time.Time
+		if started < len(ips) {
+			delay = time.After(connectionAttemptDelay)
+		}
+		select {
+		case result := <-results:
+			pending--
+			if result.err != nil {
+				failed[result.index] = true
+				attempt := &Attempt{MX: mx, IP: ips[result.index], Err: result.err}
+				if result.source != nil {
+					attempt.LocalIP = result.source.IP
+				}
+				attempts = append(attempts, attempt)
+				if started < len(ips) {
+					start()
+				}
+				continue
+			}
+			if s.Metrics != nil {
+				s.Metrics.ConnectLatency(result.elapsed)
+			}
+			// Close the connections of the attempts that lost the race
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					if loser := <-results; loser.conn != nil {
+						loser.conn.Close()
+					}
+				}
+			}(pending)
+			var rest []net.IP
+			for i, ip := range ips {
+				if i != result.index && !failed[i] {
+					rest = append(rest, ip)
+				}
+			}
+			return result.conn, ips[result.index], result.source, attempts, rest
+		case <-delay:
+			start()
+		}
+	}
+	return nil, nil, nil, attempts, nil
+}
@@ -0,0 +1,69 @@
+package ms
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSortIPs(t *testing.T) {
+	addrs := []net.IPAddr{
+		{IP: net.ParseIP("192.0.2.1")},
+		{IP: net.ParseIP("192.0.2.2")},
+		{IP: net.ParseIP("192.0.2.3")},
+		{IP: net.ParseIP("2001:db8::1")},
+		{IP: net.ParseIP("2001:db8::2")},
+	}
+	tests := []struct {
+		family AddressFamily
+		want   []string
+	}{
+		{AnyFamily, []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"}},
+		{PreferIPv4, []string{"192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2", "192.0.2.3"}},
+		{OnlyIPv4, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}},
+		{OnlyIPv6, []string{"2001:db8::1", "2001:db8::2"}},
+	}
+	for _, test := range tests {
+		ips := sortIPs(addrs, test.family)
+		if len(ips) != len(test.want) {
+			t.Errorf("Invalid addresses for %v: %v", test.family, ips)
+			continue
+		}
+		for i, ip := range ips {
+			if ip.String() != test.want[i] {
+				t.Errorf("Invalid addresses for %v: %v", test.family, ips)
+				break
+			}
+		}
+	}
+}
+
+func TestService_dial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("cannot listen on loopback:", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	s := &Service{}
+	// Only the port of the listener is reachable, both addresses are tried through it
+	conn, ip, source, failed, rest := s.dial(&delivery{}, "mx.example.com", []net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1")}, port)
+	if conn == nil {
+		t.Fatal("No connection is established, failed attempts:", failed)
+	}
+	conn.Close()
+	if source != nil {
+		t.Error("Source is selected without an IP pool")
+	}
+	if len(failed)+len(rest)+1 != 2 || ip == nil {
+		t.Error("Addresses are lost:", ip, failed, rest)
+	}
+}
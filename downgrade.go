@@ -0,0 +1,151 @@
+package ms
+
+import (
+	"bytes"
+	"encoding/base64"
+	"mime"
+	"strings"
+)
+
+// has8bit reports whether the data has any bytes that aren't 7-bit ASCII
+func has8bit(data []byte) bool {
+	for _, b := range data {
+		if b >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// downgrade converts the 8-bit MIME parts of the mail to 7-bit for the servers without 8BITMIME (RFC 6152)
+// Text parts are encoded with quoted-printable and the others with base64
+// The DKIM signatures are removed and the mail is signed again if sign is set, since the conversion breaks them
+func (s *Service) downgrade(data []byte, sign bool) ([]byte, error) {
+	m, err := ReadMail(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if m.Headers["Content-Type"] == nil && m.Headers["MIME-Version"] == nil {
+		m.Headers["MIME-Version"] = []byte("1.0")
+		m.Headers["Content-Type"] = []byte("text/plain; charset=utf-8")
+	}
+	err = downgradeEntity(m)
+	if err != nil {
+		return nil, err
+	}
+	if !sign {
+		return m.encode(), nil
+	}
+	delete(m.Headers, "DKIM-Signature")
+	return s.sign(m)
+}
+
+// downgradeEntity converts the body of the MIME entity and its parts in place
+func downgradeEntity(m *Mail) error {
+	if !has8bit(m.Body) {
+		return nil
+	}
+	mediaType, params, err := mime.ParseMediaType(string(m.Headers["Content-Type"]))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	encoding := strings.ToLower(string(m.Headers["Content-Transfer-Encoding"]))
+	switch {
+	case encoding == "quoted-printable" || encoding == "base64":
+		// The body is encoded already, the 8-bit bytes are invalid and are left as they are
+		return nil
+	case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "":
+		m.Body, err = downgradeMultipart(m.Body, params["boundary"])
+	case mediaType == "message/rfc822" || mediaType == "message/global":
+		// Message entities can't be encoded, the message inside is converted instead
+		var inner *Mail
+		inner, err = ReadMail(bytes.NewReader(m.Body))
+		if err == nil {
+			err = downgradeEntity(inner)
+			m.Body = inner.encode()
+		}
+	case strings.HasPrefix(mediaType, "text/"):
+		m.Body, err = encodeQuotedPrintable(m.Body)
+		encoding = "quoted-printable"
+	default:
+		m.Body = encodeBase64(m.Body)
+		encoding = "base64"
+	}
+	if err != nil {
+		return err
+	}
+	if encoding == "8bit" || encoding == "binary" {
+		encoding = "7bit"
+	}
+	if encoding != "" {
+		m.Headers["Content-Transfer-Encoding"] = []byte(encoding)
+	}
+	return nil
+}
+
+// downgradeMultipart converts the parts of the multipart body separated with the boundary
+// The preamble, the epilogue and the delimiters are kept as they are
+func downgradeMultipart(body []byte, boundary string) ([]byte, error) {
+	delimiter := []byte("--" + boundary)
+	var buffer bytes.Buffer
+	start, pos := 0, 0
+	inPart := false
+	for {
+		i := bytes.Index(body[pos:], delimiter)
+		if i < 0 {
+			break
+		}
+		i += pos
+		pos = i + len(delimiter)
+		if i > 0 && body[i-1] != '\n' {
+			continue
+		}
+		// The line break before the delimiter belongs to it
+		end := i
+		if end > start && body[end-1] == '\n' {
+			end--
+			if end > start && body[end-1] == '\r' {
+				end--
+			}
+		}
+		if inPart {
+			part, err := ReadMail(bytes.NewReader(body[start:end]))
+			if err != nil {
+				return nil, err
+			}
+			err = downgradeEntity(part)
+			if err != nil {
+				return nil, err
+			}
+			buffer.Write(part.encode())
+		} else {
+			buffer.Write(body[start:end])
+		}
+		lineEnd := len(body)
+		if j := bytes.IndexByte(body[pos:], '\n'); j >= 0 {
+			lineEnd = pos + j + 1
+		}
+		buffer.Write(body[end:lineEnd])
+		start, pos = lineEnd, lineEnd
+		if bytes.HasPrefix(body[i+len(delimiter):], []byte("--")) {
+			break
+		}
+		inPart = true
+	}
+	buffer.Write(body[start:])
+	return buffer.Bytes(), nil
+}
+
+// encodeBase64 encodes the data with base64 in lines of 76 characters
+func encodeBase64(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var buffer bytes.Buffer
+	for len(encoded) > 76 {
+		buffer.WriteString(encoded[:76])
+		buffer.WriteString("\r\n")
+		encoded = encoded[76:]
+	}
+	buffer.WriteString(encoded)
+	buffer.WriteString("\r\n")
+	return buffer.Bytes()
+}
@@ -0,0 +1,79 @@
+package ms
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"mime/multipart"
+	"net/mail"
+	"testing"
+)
+
+func TestService_downgrade(t *testing.T) {
+	s := newTestService(t)
+	m := &Mail{
+		Headers: map[string][]byte{
+			"From":                      []byte("joe@example.org"),
+			"To":                        []byte("jane@example.com"),
+			"MIME-Version":              []byte("1.0"),
+			"Content-Type":              []byte("multipart/mixed; boundary=b1"),
+			"Content-Transfer-Encoding": []byte("8bit"),
+		},
+		Body: []byte("Preamble\r\n--b1\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\nGrüße\r\n" +
+			"--b1\r\nContent-Type: application/octet-stream\r\n\r\n\xff\xfe\r\n" +
+			"--b1\r\nContent-Type: text/plain\r\n\r\nPlain\r\n--b1--\r\n"),
+	}
+	signed, err := s.sign(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := s.downgrade(signed, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if has8bit(data) {
+		t.Fatalf("Mail has 8-bit content: %q", data)
+	}
+	if bytes.Count(data, []byte("DKIM-Signature:")) != 1 || bytes.Equal(data, signed) {
+		t.Error("Mail is not signed again")
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("Content-Transfer-Encoding") != "7bit" {
+		t.Error("Invalid transfer encoding:", msg.Header.Get("Content-Transfer-Encoding"))
+	}
+	reader := multipart.NewReader(msg.Body, "b1")
+	expected := []struct {
+		encoding string
+		content  string
+	}{
+		{"quoted-printable", "Grüße"},
+		{"base64", "\xff\xfe"},
+		{"", "Plain"},
+	}
+	for _, e := range expected {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The multipart reader decodes and removes the quoted-printable header
+		if e.encoding == "base64" && part.Header.Get("Content-Transfer-Encoding") != "base64" {
+			t.Error("Invalid transfer encoding:", part.Header)
+		}
+		if e.encoding == "base64" {
+			content, err = base64.StdEncoding.DecodeString(string(bytes.TrimSpace(content)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if string(bytes.TrimRight(content, "\r\n")) != e.content {
+			t.Errorf("Invalid content: %q", content)
+		}
+	}
+}
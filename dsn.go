@@ -0,0 +1,150 @@
+package ms
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/cevatbarisyilmaz/ms/smtp"
+	"github.com/pkg/errors"
+	"mime/multipart"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// NewDSN builds a delivery status notification (RFC 3464) for the permanently failed recipients in the report
+// reportingMTA is the domain name of the host that attempted the delivery
+// to is the email address of the original sender to notify
+// m is the original mail, its headers are attached to the notification
+// The Arrival of the report is the Arrival-Date of the notification, the field is omitted if it is zero
+func NewDSN(reportingMTA string, to string, m *Mail, report *Report) (*Mail, error) {
+	var failed []*Result
+	for _, result := range report.Recipients {
+		if result.Status == Failed {
+			failed = append(failed, result)
+		}
+	}
+	if len(failed) == 0 {
+		return nil, errors.New("there are no failed recipients to report")
+	}
+	sort.Slice(failed, func(i, j int) bool {
+		return failed[i].Recipient < failed[j].Recipient
+	})
+	now := time.Now()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(part, "This is the mail system at host %s.\r\n\r\n", reportingMTA)
+	fmt.Fprint(part, "Your message could not be delivered to one or more recipients.\r\n")
+	fmt.Fprint(part, "This is a permanent error. The following addresses failed:\r\n\r\n")
+	for _, result := range failed {
+		fmt.Fprintf(part, "<%s>: %s\r\n", result.Recipient, oneLine(result.Err.Error()))
+	}
+
+	part, err = writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"message/delivery-status"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(part, "Reporting-MTA: dns; %s\r\n", reportingMTA)
+	if !report.Arrival.IsZero() {
+		fmt.Fprintf(part, "Arrival-Date: %s\r\n", report.Arrival.Format(time.RFC1123Z))
+	}
+	for _, result := range failed {
+		fmt.Fprint(part, "\r\n")
+		fmt.Fprintf(part, "Final-Recipient: rfc822; %s\r\n", result.Recipient)
+		fmt.Fprint(part, "Action: failed\r\n")
+		fmt.Fprintf(part, "Status: %s\r\n", dsnStatus(result.Err))
+		if result.MX != "" {
+			fmt.Fprintf(part, "Remote-MTA: dns; %s\r\n", result.MX)
+		}
+		if smtpErr, ok := result.Err.(*smtp.SMTPError); ok {
+			fmt.Fprintf(part, "Diagnostic-Code: smtp; %s\r\n", smtpReply(smtpErr))
+		}
+		fmt.Fprintf(part, "Last-Attempt-Date: %s\r\n", now.Format(time.RFC1123Z))
+	}
+
+	part, err = writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/rfc822-headers"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var headers bytes.Buffer
+	m.encodeHeaders(&headers)
+	_, err = part.Write(headers.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	dsn := &Mail{
+		Headers: map[string][]byte{
+			"From":           []byte("\"Mail Delivery System\" <MAILER-DAEMON@" + reportingMTA + ">"),
+			"To":             []byte(to),
+			"Subject":        []byte("Undelivered Mail Returned to Sender"),
+			"Date":           []byte(now.Format(time.RFC1123Z)),
+			"Auto-Submitted": []byte("auto-replied"),
+			"MIME-Version":   []byte("1.0"),
+			"Content-Type":   []byte("multipart/report; report-type=delivery-status; boundary=\"" + writer.Boundary() + "\""),
+		},
+		Body: body.Bytes(),
+	}
+	if messageID, ok := m.Headers["Message-ID"]; ok {
+		dsn.Headers["In-Reply-To"] = messageID
+		dsn.Headers["References"] = messageID
+	}
+	return dsn, nil
+}
+
+// bounce notifies the sender about the permanently failed recipients and returns the report of the notification
+// Nothing is sent if no recipient failed or for the null reverse-path so that bounces never bounce back
+func (s *Service) bounce(m *Mail, sender string, report *Report) (*Report, error) {
+	if sender == "" || !report.failed() {
+		return nil, nil
+	}
+	dsn, err := NewDSN(s.domain, sender, m, report)
+	if err != nil {
+		return nil, errors.Wrap(err, "building delivery status notification failed")
+	}
+	bounceReport, err := s.deliver(dsn, "", deliverOptions{sign: true})
+	if err != nil {
+		return nil, errors.Wrap(err, "sending delivery status notification failed")
+	}
+	return bounceReport, nil
+}
+
+// dsnStatus returns the status code (RFC 3463) of a permanent failure
+func dsnStatus(err error) string {
+	if smtpErr, ok := err.(*smtp.SMTPError); ok {
+		code := smtpErr.EnhancedCode
+		if code[0] == 5 {
+			return fmt.Sprintf("%d.%d.%d", code[0], code[1], code[2])
+		}
+	}
+	return "5.0.0"
+}
+
+// smtpReply reconstructs the reply line of the remote SMTP server
+func smtpReply(err *smtp.SMTPError) string {
+	code := err.EnhancedCode
+	if code == smtp.EnhancedCodeNotSet || code == smtp.NoEnhancedCode {
+		return fmt.Sprintf("%d %s", err.Code, oneLine(err.Message))
+	}
+	return fmt.Sprintf("%d %d.%d.%d %s", err.Code, code[0], code[1], code[2], oneLine(err.Message))
+}
+
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
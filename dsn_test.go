@@ -0,0 +1,120 @@
+package ms
+
+import (
+	"bytes"
+	"errors"
+	"github.com/cevatbarisyilmaz/ms/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewDSN(t *testing.T) {
+	m := &Mail{
+		Headers: map[string][]byte{
+			"From":       []byte("sender@example.org"),
+			"To":         []byte("a@example.com, b@example.com"),
+			"Subject":    []byte("Hello"),
+			"Message-ID": []byte("<1.2.3@example.org>"),
+		},
+		Body: []byte("Hi!"),
+	}
+	arrival := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	report := &Report{
+		MessageID: "<1.2.3@example.org>",
+		Arrival:   arrival,
+		Recipients: map[string]*Result{
+			"a@example.com": {
+				Recipient: "a@example.com",
+				Status:    Failed,
+				MX:        "mx.example.com",
+				Err: &smtp.SMTPError{
+					Code:         550,
+					EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+					Message:      "No such user",
+				},
+			},
+			"b@example.com": {
+				Recipient: "b@example.com",
+				Status:    Deferred,
+				Err:       errors.New("connection refused"),
+			},
+		},
+	}
+	dsn, err := NewDSN("example.org", "sender@example.org", m, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(dsn.Headers["Content-Type"], []byte("multipart/report; report-type=delivery-status;")) {
+		t.Error("Invalid Content-Type:", string(dsn.Headers["Content-Type"]))
+	}
+	if string(dsn.Headers["In-Reply-To"]) != "<1.2.3@example.org>" {
+		t.Error("Invalid In-Reply-To:", string(dsn.Headers["In-Reply-To"]))
+	}
+	body := string(dsn.Body)
+	for _, field := range []string{
+		"Reporting-MTA: dns; example.org\r\n",
+		"Arrival-Date: " + arrival.Format(time.RFC1123Z) + "\r\n",
+		"Final-Recipient: rfc822; a@example.com\r\n",
+		"Action: failed\r\n",
+		"Status: 5.1.1\r\n",
+		"Remote-MTA: dns; mx.example.com\r\n",
+		"Diagnostic-Code: smtp; 550 5.1.1 No such user\r\n",
+		"Subject: Hello\r\n",
+	} {
+		if !strings.Contains(body, field) {
+			t.Errorf("DSN is missing %q", field)
+		}
+	}
+	if strings.Contains(body, "Final-Recipient: rfc822; b@example.com") {
+		t.Error("DSN reports a deferred recipient")
+	}
+
+	delete(report.Recipients, "a@example.com")
+	_, err = NewDSN("example.org", "sender@example.org", m, report)
+	if err == nil {
+		t.Error("Expected an error for a report without failed recipients")
+	}
+}
+
+func TestService_bounce(t *testing.T) {
+	transport := &MemoryTransport{}
+	s := newTestService(t)
+	s.Transport = transport
+	m := &Mail{
+		Headers: map[string][]byte{
+			"From":       []byte("sender@example.org"),
+			"To":         []byte("a@example.com"),
+			"Message-ID": []byte("<1.2.3@example.org>"),
+		},
+		Body: []byte("Hi!"),
+	}
+	report := &Report{
+		MessageID: "<1.2.3@example.org>",
+		Arrival:   time.Now(),
+		Recipients: map[string]*Result{
+			"a@example.com": {Recipient: "a@example.com", Status: Delivered},
+		},
+	}
+	if bounce, err := s.bounce(m, "sender@example.org", report); bounce != nil || err != nil {
+		t.Fatal("Bounced without failed recipients:", bounce, err)
+	}
+
+	report.Recipients["a@example.com"] = &Result{Recipient: "a@example.com", Status: Failed, Err: errors.New("blocked")}
+	if bounce, err := s.bounce(m, "", report); bounce != nil || err != nil {
+		t.Fatal("Bounced to the null reverse-path:", bounce, err)
+	}
+	bounce, err := s.bounce(m, "sender@example.org", report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bounce.Recipients["sender@example.org"].Status != Delivered || len(transport.Mails()) != 1 {
+		t.Error("Notification is not sent:", bounce)
+	}
+
+	// The failures of the notification are returned rather than dropped
+	bounce, err = s.bounce(m, "not an address", report)
+	if bounce != nil || err == nil {
+		t.Error("Failed notification is not reported:", bounce, err)
+	}
+}
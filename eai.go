@@ -0,0 +1,62 @@
+package ms
+
+import (
+	"github.com/cevatbarisyilmaz/ms/smtp"
+	"github.com/pkg/errors"
+	"golang.org/x/net/idna"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrSMTPUTF8Required is the error of the recipients with non-ASCII local parts
+// whose servers don't support internationalized email (RFC 6531)
+var ErrSMTPUTF8Required = &smtp.SMTPError{
+	Code:         553,
+	EnhancedCode: smtp.EnhancedCode{5, 6, 7},
+	Message:      "Non-ASCII address is not supported by the receiving server",
+}
+
+// domainToASCII converts an internationalized domain name to the ASCII form used in DNS and SMTP
+// The name is mapped and validated with the IDNA lookup profile (UTS #46), such as normalizing it to NFC
+// and mapping fullwidth characters, before its labels are encoded with Punycode
+func domainToASCII(domain string) (string, error) {
+	if isASCII(domain) {
+		return domain, nil
+	}
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid domain")
+	}
+	for _, label := range strings.Split(ascii, ".") {
+		if len(label) > 63 {
+			return "", errors.New("domain label is too long: " + label)
+		}
+	}
+	return ascii, nil
+}
+
+// envelopeAddr returns the address with its domain converted to ASCII for the SMTP envelope
+// Only the local part of the returned address can be non-ASCII, the empty address stays empty
+func envelopeAddr(addr string) (string, error) {
+	if addr == "" || isASCII(addr) {
+		return addr, nil
+	}
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return "", errors.New("invalid mail address")
+	}
+	domain, err := domainToASCII(addr[at+1:])
+	if err != nil {
+		return "", err
+	}
+	return addr[:at+1] + domain, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
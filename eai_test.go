@@ -0,0 +1,44 @@
+package ms
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDomainToASCII(t *testing.T) {
+	tests := map[string]string{
+		"example.com":            "example.com",
+		"bücher.example":         "xn--bcher-kva.example",
+		"Bücher.example":         "xn--bcher-kva.example",
+		"παράδειγμα.δοκιμή":      "xn--hxajbheg2az3al.xn--jxalpdlp",
+		"例え。テスト":                 "xn--r8jz45g.xn--zckzah",
+		"ليهمابتكلموشعربي؟.test": "xn--egbpdaj6bu4bxfgehfvwxn.test",
+		// NFD form is normalized to NFC
+		"mu\u0308nchen.de": "xn--mnchen-3ya.de",
+		// Fullwidth characters are mapped to their ASCII forms
+		"ＥＸＡＭＰＬＥ.ｃｏｍ": "example.com",
+	}
+	for domain, expected := range tests {
+		ascii, err := domainToASCII(domain)
+		if err != nil || ascii != expected {
+			t.Errorf("%s is converted to %s, expected %s: %v", domain, ascii, expected, err)
+		}
+	}
+	if ascii, err := domainToASCII(strings.Repeat("ü", 60) + ".example"); err == nil {
+		t.Error("Too long label is accepted:", ascii)
+	}
+}
+
+func TestEnvelopeAddr(t *testing.T) {
+	addr, err := envelopeAddr("jöe@bücher.example")
+	if err != nil || addr != "jöe@xn--bcher-kva.example" {
+		t.Error("Invalid envelope address:", addr, err)
+	}
+	addr, err = envelopeAddr("")
+	if err != nil || addr != "" {
+		t.Error("Null reverse-path is changed:", addr, err)
+	}
+	if _, err = envelopeAddr("jöe"); err == nil {
+		t.Error("Invalid address is accepted")
+	}
+}
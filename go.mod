@@ -6,4 +6,5 @@ require (
 	github.com/emersion/go-msgauth v0.4.0
 	github.com/emersion/go-sasl v0.0.0-20190817083125-240c8404624e
 	github.com/pkg/errors v0.9.1
+	golang.org/x/net v0.17.0
 )
@@ -0,0 +1,22 @@
+// Package mimeutil provides the MIME helpers shared by the packages of ms
+package mimeutil
+
+import (
+	"encoding/base64"
+	"io"
+	"mime/quotedprintable"
+	"strings"
+)
+
+// DecodeTransferEncoding returns the reader of the decoded body of a MIME entity with the Content-Transfer-Encoding
+// The body is returned as it is for the identity encodings and the unknown ones
+// The line breaks of base64 bodies are ignored by the decoder
+func DecodeTransferEncoding(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
@@ -0,0 +1,30 @@
+package mimeutil
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestDecodeTransferEncoding(t *testing.T) {
+	for _, e := range []struct {
+		encoding string
+		body     string
+		decoded  string
+	}{
+		{"base64", "SGVsbG8g\r\nd29ybGQ=\r\n", "Hello world"},
+		{" Base64 ", "SGVsbG8=", "Hello"},
+		{"quoted-printable", "Gr=C3=BC=\r\n=C3=9Fe", "Grüße"},
+		{"7bit", "Hello", "Hello"},
+		{"", "Hello", "Hello"},
+	} {
+		decoded, err := ioutil.ReadAll(DecodeTransferEncoding(e.encoding, strings.NewReader(e.body)))
+		if err != nil {
+			t.Errorf("%q: %v", e.encoding, err)
+			continue
+		}
+		if string(decoded) != e.decoded {
+			t.Errorf("%q: got %q, expected %q", e.encoding, decoded, e.decoded)
+		}
+	}
+}
@@ -2,6 +2,10 @@ package ms
 
 import (
 	"bytes"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net/textproto"
 )
 
 // Mail holds mail headers and the body to send
@@ -10,18 +14,163 @@ type Mail struct {
 	// Such as "From", "To" etc.
 	Headers map[string][]byte
 	Body    []byte
+	// Pool is the name of the IP pool of the Service to send the mail from
+	// It overrides the default pool of the Service if set
+	Pool string
+
+	// header is the header section as it is read if the mail is read with ReadMail
+	header *rawHeader
+}
+
+// rawHeader is the header section of a mail as it is read
+type rawHeader struct {
+	fields []*rawField
+	// separator is the empty line ending the header section, it is empty if the mail has no body
+	separator []byte
+}
+
+// rawField is a header field as it is read
+type rawField struct {
+	key string
+	// value is the unfolded value of the field as it is put into Headers
+	value []byte
+	// raw is the field with its original folding and line endings
+	raw []byte
+}
+
+// ReadMail parses a raw message (RFC 5322) into a Mail
+// The order and the folding of the header fields are kept, so Bytes returns the exact message read
+// unless the headers are changed. Headers holds the unfolded value of the first field of each name
+// Changed headers are written in place of the original fields, the added ones are written after them
+func ReadMail(r io.Reader) (*Mail, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading mail failed")
+	}
+	m := &Mail{
+		Headers: map[string][]byte{},
+		header:  &rawHeader{},
+	}
+	pos, start := 0, 0
+	for pos < len(data) {
+		end := len(data)
+		if i := bytes.IndexByte(data[pos:], '\n'); i >= 0 {
+			end = pos + i + 1
+		}
+		line := data[pos:end]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			m.header.separator = line
+			pos = end
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(m.header.fields) == 0 {
+				return nil, errors.New("mail starts with a folded line")
+			}
+			m.header.fields[len(m.header.fields)-1].raw = data[start:end]
+		} else {
+			if bytes.IndexByte(line, ':') <= 0 {
+				return nil, errors.New("malformed header line: " + string(bytes.TrimRight(line, "\r\n")))
+			}
+			start = pos
+			m.header.fields = append(m.header.fields, &rawField{raw: line})
+		}
+		pos = end
+	}
+	for _, field := range m.header.fields {
+		colon := bytes.IndexByte(field.raw, ':')
+		field.key = headerKey(string(bytes.TrimSpace(field.raw[:colon])))
+		value := bytes.ReplaceAll(field.raw[colon+1:], []byte("\n"), nil)
+		field.value = bytes.TrimSpace(bytes.ReplaceAll(value, []byte("\r"), nil))
+		if _, ok := m.Headers[field.key]; !ok {
+			m.Headers[field.key] = field.value
+		}
+	}
+	m.Body = data[pos:]
+	return m, nil
+}
+
+// headerKey returns the name of the header field in the form used by Headers such as "Message-ID"
+func headerKey(name string) string {
+	key := textproto.CanonicalMIMEHeaderKey(name)
+	switch key {
+	case "Message-Id":
+		return "Message-ID"
+	case "Mime-Version":
+		return "MIME-Version"
+	case "Dkim-Signature":
+		return "DKIM-Signature"
+	case "Content-Id":
+		return "Content-ID"
+	}
+	return key
+}
+
+// clone returns a copy of the mail whose headers can be changed without affecting the mail
+func (m *Mail) clone() *Mail {
+	c := &Mail{
+		Headers: make(map[string][]byte, len(m.Headers)),
+		Body:    m.Body,
+		Pool:    m.Pool,
+		header:  m.header,
+	}
+	for key, value := range m.Headers {
+		c.Headers[key] = value
+	}
+	return c
+}
+
+// Bytes returns the mail as it is sent without the DKIM signature
+// It returns the exact bytes read for the mails read with ReadMail unless their headers are changed
+func (m *Mail) Bytes() []byte {
+	return m.encode()
 }
 
 func (m *Mail) encode() []byte {
 	var buffer bytes.Buffer
-	for key, value := range m.Headers {
-		buffer.WriteString(key)
-		buffer.WriteString(": ")
-		buffer.Write(value)
-		buffer.WriteString("\r\n")
+	m.encodeHeaders(&buffer)
+	if m.header != nil {
+		buffer.Write(m.header.separator)
+		buffer.Write(m.Body)
+		return buffer.Bytes()
 	}
 	buffer.WriteString("\r\n")
 	buffer.Write(m.Body)
 	buffer.WriteString("\r\n")
 	return buffer.Bytes()
 }
+
+func (m *Mail) encodeHeaders(buffer *bytes.Buffer) {
+	written := map[string]bool{}
+	if m.header != nil {
+		read := map[string][]byte{}
+		for _, field := range m.header.fields {
+			if _, ok := read[field.key]; !ok {
+				read[field.key] = field.value
+			}
+		}
+		for _, field := range m.header.fields {
+			value, ok := m.Headers[field.key]
+			switch {
+			case !ok:
+			case bytes.Equal(value, read[field.key]):
+				buffer.Write(field.raw)
+			case !written[field.key]:
+				encodeHeader(buffer, field.key, value)
+			}
+			written[field.key] = true
+		}
+	}
+	for key, value := range m.Headers {
+		if !written[key] {
+			encodeHeader(buffer, key, value)
+		}
+	}
+}
+
+func encodeHeader(buffer *bytes.Buffer, key string, value []byte) {
+	buffer.WriteString(key)
+	buffer.WriteString(": ")
+	buffer.Write(value)
+	buffer.WriteString("\r\n")
+}
@@ -0,0 +1,100 @@
+package ms
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const testRawMail = "Received: from a.example.com\r\n\tby b.example.com\r\n" +
+	"Received: from c.example.com\r\n" +
+	"DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=old;\r\n\th=From:To; b=c2lnbmF0dXJl\r\n" +
+	"From: Joe <joe@example.com>\r\n" +
+	"To: jane@example.net\r\n" +
+	"Bcc: bob@example.net\r\n" +
+	"Subject: A long subject\r\n folded\r\n" +
+	"Message-Id: <1@example.com>\r\n" +
+	"\r\n" +
+	"Hello\r\n"
+
+func TestReadMail(t *testing.T) {
+	m, err := ReadMail(strings.NewReader(testRawMail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m.Headers["Subject"]) != "A long subject folded" {
+		t.Errorf("Invalid subject: %q", m.Headers["Subject"])
+	}
+	if string(m.Headers["Received"]) != "from a.example.com\tby b.example.com" {
+		t.Errorf("Invalid received: %q", m.Headers["Received"])
+	}
+	if string(m.Headers["Message-ID"]) != "<1@example.com>" || string(m.Body) != "Hello\r\n" {
+		t.Errorf("Invalid mail: %q %q", m.Headers["Message-ID"], m.Body)
+	}
+	if string(m.Bytes()) != testRawMail {
+		t.Errorf("Invalid encoding: %q", m.Bytes())
+	}
+
+	m.Headers["Subject"] = []byte("Changed")
+	delete(m.Headers, "Received")
+	m.Headers["X-Mailer"] = []byte("ms")
+	expected := strings.Replace(testRawMail, "Subject: A long subject\r\n folded\r\n", "Subject: Changed\r\n", 1)
+	expected = expected[strings.Index(expected, "DKIM-Signature"):]
+	expected = strings.Replace(expected, "\r\n\r\n", "\r\nX-Mailer: ms\r\n\r\n", 1)
+	if string(m.Bytes()) != expected {
+		t.Errorf("Invalid encoding of the changed mail: %q", m.Bytes())
+	}
+
+	m, err = ReadMail(strings.NewReader("Subject: Hello\nTo: joe@example.com\n\nHello\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m.Bytes()) != "Subject: Hello\nTo: joe@example.com\n\nHello\n" {
+		t.Errorf("Invalid encoding of the mail with LF line endings: %q", m.Bytes())
+	}
+
+	_, err = ReadMail(strings.NewReader("Subject: Hello\r\nnot a header\r\n\r\n"))
+	if err == nil {
+		t.Error("Malformed mail is read")
+	}
+}
+
+func TestService_SendRaw(t *testing.T) {
+	transport := &MemoryTransport{}
+	s := newTestService(t)
+	s.Transport = transport
+	m, err := ReadMail(strings.NewReader(testRawMail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := s.SendRaw(m, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.MessageID != "<1@example.com>" || len(report.Recipients) != 2 {
+		t.Fatal("Invalid report:", report.MessageID, report.Recipients)
+	}
+	mails := transport.Mails()
+	if len(mails) != 1 || mails[0].Envelope.Sender != "joe@example.com" {
+		t.Fatal("Invalid mails:", mails)
+	}
+	if string(mails[0].Data) != strings.Replace(testRawMail, "Bcc: bob@example.net\r\n", "", 1) {
+		t.Errorf("Mail is not sent as it is: %q", mails[0].Data)
+	}
+	if string(m.Bytes()) != testRawMail {
+		t.Error("Mail is modified")
+	}
+
+	transport.Reset()
+	_, err = s.SendRaw(m, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := transport.Mails()[0].Data
+	if bytes.Count(data, []byte("DKIM-Signature:")) != 1 || !bytes.Contains(data, []byte("d=example.org")) {
+		t.Errorf("Mail is not signed again: %q", data)
+	}
+	if !bytes.Contains(data, []byte("Subject: A long subject\r\n folded\r\nMessage-Id: <1@example.com>\r\n")) {
+		t.Errorf("Headers are not kept: %q", data)
+	}
+}
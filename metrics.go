@@ -0,0 +1,233 @@
+package ms
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/cevatbarisyilmaz/ms/smtp"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics collects the measurements of the service
+// The methods are called concurrently during Send and Deliver, so they should be safe for concurrent use
+type Metrics interface {
+	// MessageSent is called once for each mail accepted for delivery
+	MessageSent()
+	// RecipientDone is called with the outcome of the delivery to a recipient
+	// class is the class of the enhanced status code such as "2", "4" or "5", or "none" if the outcome has no code
+	RecipientDone(domain string, status Status, class string)
+	// ConnectLatency is called with the duration of each established connection to an MX host
+	ConnectLatency(d time.Duration)
+	// TLSHandshakeLatency is called with the duration of each STARTTLS negotiation
+	TLSHandshakeLatency(d time.Duration)
+	// SigningTime is called with the duration of each DKIM signing
+	SigningTime(d time.Duration)
+	// QueueDepth is called with the number of recipients waiting for delivery whenever it changes
+	QueueDepth(n int)
+}
+
+// codeClass returns the class of the enhanced status code of the outcome of a delivery
+func codeClass(status Status, err error) string {
+	if status == Delivered {
+		return "2"
+	}
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		return "none"
+	}
+	if smtpErr.EnhancedCode[0] > 0 {
+		return strconv.Itoa(smtpErr.EnhancedCode[0])
+	}
+	return strconv.Itoa(smtpErr.Code / 100)
+}
+
+func (s *Service) measureMessage(recipients int) {
+	if s.Metrics == nil {
+		return
+	}
+	s.Metrics.MessageSent()
+	s.Metrics.QueueDepth(int(atomic.AddInt32(&s.queued, int32(recipients))))
+}
+
+func (s *Service) measureResult(result *Result) {
+	if s.Metrics == nil {
+		return
+	}
+	domain, err := resolveAddr(result.Recipient)
+	if err != nil {
+		domain = ""
+	}
+	s.Metrics.RecipientDone(strings.ToLower(domain), result.Status, codeClass(result.Status, result.Err))
+	s.Metrics.QueueDepth(int(atomic.AddInt32(&s.queued, -1)))
+}
+
+// defaultBuckets are the upper bounds of the latency histograms in seconds
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	for i, bound := range defaultBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+type recipientKey struct {
+	domain string
+	status Status
+	class  string
+}
+
+// PrometheusMetrics is a Metrics that exposes the measurements in the Prometheus text format
+// It implements http.Handler to be served as a scrape target such as
+//
+//	http.Handle("/metrics", metrics)
+type PrometheusMetrics struct {
+	mu           sync.Mutex
+	messages     uint64
+	recipients   map[recipientKey]uint64
+	connect      *histogram
+	tlsHandshake *histogram
+	signing      *histogram
+	queueDepth   int
+}
+
+// NewPrometheusMetrics returns an empty PrometheusMetrics
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		recipients:   map[recipientKey]uint64{},
+		connect:      &histogram{counts: make([]uint64, len(defaultBuckets))},
+		tlsHandshake: &histogram{counts: make([]uint64, len(defaultBuckets))},
+		signing:      &histogram{counts: make([]uint64, len(defaultBuckets))},
+	}
+}
+
+// MessageSent counts the mail
+func (m *PrometheusMetrics) MessageSent() {
+	m.mu.Lock()
+	m.messages++
+	m.mu.Unlock()
+}
+
+// RecipientDone counts the outcome
+func (m *PrometheusMetrics) RecipientDone(domain string, status Status, class string) {
+	m.mu.Lock()
+	m.recipients[recipientKey{domain: domain, status: status, class: class}]++
+	m.mu.Unlock()
+}
+
+// ConnectLatency records the duration
+func (m *PrometheusMetrics) ConnectLatency(d time.Duration) {
+	m.mu.Lock()
+	m.connect.observe(d)
+	m.mu.Unlock()
+}
+
+// TLSHandshakeLatency records the duration
+func (m *PrometheusMetrics) TLSHandshakeLatency(d time.Duration) {
+	m.mu.Lock()
+	m.tlsHandshake.observe(d)
+	m.mu.Unlock()
+}
+
+// SigningTime records the duration
+func (m *PrometheusMetrics) SigningTime(d time.Duration) {
+	m.mu.Lock()
+	m.signing.observe(d)
+	m.mu.Unlock()
+}
+
+// QueueDepth records the number of the recipients waiting for delivery
+func (m *PrometheusMetrics) QueueDepth(n int) {
+	m.mu.Lock()
+	m.queueDepth = n
+	m.mu.Unlock()
+}
+
+// ServeHTTP writes the measurements in the Prometheus text format
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the measurements in the Prometheus text format
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := &countingWriter{w: w}
+	b := bufio.NewWriter(c)
+
+	writeHeader(b, "ms_messages_sent_total", "counter", "Mails accepted for delivery.")
+	fmt.Fprintf(b, "ms_messages_sent_total %d\n", m.messages)
+
+	writeHeader(b, "ms_recipients_total", "counter", "Deliveries to recipients by outcome and enhanced status code class.")
+	keys := make([]recipientKey, 0, len(m.recipients))
+	for key := range m.recipients {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].domain != keys[j].domain {
+			return keys[i].domain < keys[j].domain
+		}
+		if keys[i].status != keys[j].status {
+			return keys[i].status < keys[j].status
+		}
+		return keys[i].class < keys[j].class
+	})
+	for _, key := range keys {
+		fmt.Fprintf(b, "ms_recipients_total{domain=\"%s\",status=\"%s\",class=\"%s\"} %d\n",
+			labelEscaper.Replace(key.domain), key.status, labelEscaper.Replace(key.class), m.recipients[key])
+	}
+
+	writeHistogram(b, "ms_mx_connect_seconds", "Latency of establishing connections to MX hosts.", m.connect)
+	writeHistogram(b, "ms_tls_handshake_seconds", "Latency of STARTTLS negotiations.", m.tlsHandshake)
+	writeHistogram(b, "ms_dkim_signing_seconds", "Time spent signing mails with DKIM.", m.signing)
+
+	writeHeader(b, "ms_queue_depth", "gauge", "Recipients waiting for delivery.")
+	fmt.Fprintf(b, "ms_queue_depth %d\n", m.queueDepth)
+
+	err := b.Flush()
+	return c.n, err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeHistogram(w io.Writer, name string, help string, h *histogram) {
+	writeHeader(w, name, "histogram", help)
+	for i, bound := range defaultBuckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
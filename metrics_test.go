@@ -0,0 +1,66 @@
+package ms
+
+import (
+	"bytes"
+	"errors"
+	"github.com/cevatbarisyilmaz/ms/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	metrics := NewPrometheusMetrics()
+	s := &Service{Metrics: metrics}
+	s.measureMessage(3)
+	s.measureResult(&Result{Recipient: "joe@Example.com", Status: Delivered})
+	s.measureResult(&Result{
+		Recipient: "jane@example.com",
+		Status:    Failed,
+		Err:       &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"},
+	})
+	metrics.ConnectLatency(30 * time.Millisecond)
+	metrics.SigningTime(2 * time.Millisecond)
+
+	var buffer bytes.Buffer
+	n, err := metrics.WriteTo(&buffer)
+	if err != nil || n != int64(buffer.Len()) {
+		t.Fatal("Writing metrics failed:", n, err)
+	}
+	output := buffer.String()
+	for _, line := range []string{
+		"# TYPE ms_messages_sent_total counter",
+		"ms_messages_sent_total 1",
+		`ms_recipients_total{domain="example.com",status="delivered",class="2"} 1`,
+		`ms_recipients_total{domain="example.com",status="failed",class="5"} 1`,
+		`ms_mx_connect_seconds_bucket{le="0.025"} 0`,
+		`ms_mx_connect_seconds_bucket{le="0.05"} 1`,
+		`ms_mx_connect_seconds_bucket{le="+Inf"} 1`,
+		"ms_mx_connect_seconds_count 1",
+		"ms_tls_handshake_seconds_count 0",
+		"ms_dkim_signing_seconds_count 1",
+		"ms_queue_depth 1",
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("Metrics don't contain %q:\n%s", line, output)
+		}
+	}
+}
+
+func TestCodeClass(t *testing.T) {
+	tests := []struct {
+		status Status
+		err    error
+		class  string
+	}{
+		{Delivered, nil, "2"},
+		{Deferred, &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 1}}, "4"},
+		{Failed, &smtp.SMTPError{Code: 554}, "5"},
+		{Deferred, errors.New("connection refused"), "none"},
+	}
+	for _, test := range tests {
+		if class := codeClass(test.status, test.err); class != test.class {
+			t.Errorf("codeClass(%v, %v) = %q, want %q", test.status, test.err, class, test.class)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package ms
+
+import (
+	"github.com/cevatbarisyilmaz/ms/smtp"
+	"net"
+	"time"
+)
+
+// defaultRetryDelay is the suggested delay for retrying deferred deliveries unless Service.RetryDelay is set
+const defaultRetryDelay = 15 * time.Minute
+
+// Event describes a step of the delivery of a mail
+type Event struct {
+	Time time.Time
+	// MessageID is the Message-ID header of the mail
+	MessageID string
+	// Recipient is the email address the event is about, it is empty for the events of the whole mail
+	Recipient string
+	// MX is the host name of the remote SMTP server if any
+	MX string
+	// IP is the address of the remote SMTP server if any
+	IP net.IP
+	// Response is the reply of the remote SMTP server if it rejected the mail
+	Response *smtp.SMTPError
+	// Err is the cause of the failure if any
+	Err error
+	// RetryAt is the suggested time to retry deferred deliveries
+	RetryAt time.Time
+}
+
+// Observer is notified about the lifecycle of the deliveries
+// The methods are called synchronously during Send and Deliver, so they should return quickly
+// Embed NopObserver to implement only some of the methods
+type Observer interface {
+	// Accepted is called once a mail is accepted for delivery
+	Accepted(e *Event)
+	// Attempt is called for each connection attempt to a remote server as soon as it finishes,
+	// before the outcome for the recipient
+	Attempt(e *Event)
+	// Delivered is called when a remote SMTP server accepts the mail for a recipient
+	Delivered(e *Event)
+	// Deferred is called when the delivery to a recipient fails temporarily
+	Deferred(e *Event)
+	// Bounced is called when the delivery to a recipient fails permanently
+	Bounced(e *Event)
+	// Suppressed is called when a recipient is skipped since it is in the suppression list
+	Suppressed(e *Event)
+}
+
+// NopObserver is an Observer that does nothing
+type NopObserver struct{}
+
+// Accepted does nothing
+func (NopObserver) Accepted(*Event) {}
+
+// Attempt does nothing
+func (NopObserver) Attempt(*Event) {}
+
+// Delivered does nothing
+func (NopObserver) Delivered(*Event) {}
+
+// Deferred does nothing
+func (NopObserver) Deferred(*Event) {}
+
+// Bounced does nothing
+func (NopObserver) Bounced(*Event) {}
+
+// Suppressed does nothing
+func (NopObserver) Suppressed(*Event) {}
+
+func newEvent(messageID string, recipient string, mx string, err error) *Event {
+	e := &Event{
+		Time:      time.Now(),
+		MessageID: messageID,
+		Recipient: recipient,
+		MX:        mx,
+		Err:       err,
+	}
+	if smtpErr, ok := err.(*smtp.SMTPError); ok {
+		e.Response = smtpErr
+	}
+	return e
+}
+
+func (s *Service) observeAccepted(d *delivery) {
+	if s.Observer == nil {
+		return
+	}
+	s.Observer.Accepted(newEvent(d.messageID, "", "", nil))
+}
+
+// observeAttempt reports the attempt to deliver the mail to the recipient once it finishes
+func (s *Service) observeAttempt(d *delivery, recipient string, attempt *Attempt) {
+	if s.Observer == nil {
+		return
+	}
+	e := newEvent(d.messageID, recipient, attempt.MX, attempt.Err)
+	e.IP = attempt.IP
+	s.Observer.Attempt(e)
+}
+
+func (s *Service) observeResult(d *delivery, result *Result) {
+	if s.Observer == nil {
+		return
+	}
+	e := newEvent(d.messageID, result.Recipient, result.MX, result.Err)
+	if len(result.Attempts) > 0 {
+		e.IP = result.Attempts[len(result.Attempts)-1].IP
+	}
+	switch result.Status {
+	case Delivered:
+		s.Observer.Delivered(e)
+	case Deferred:
+		retryDelay := s.RetryDelay
+		if retryDelay <= 0 {
+			retryDelay = defaultRetryDelay
+		}
+		e.RetryAt = e.Time.Add(retryDelay)
+		s.Observer.Deferred(e)
+	case Failed:
+		s.Observer.Bounced(e)
+	case Suppressed:
+		s.Observer.Suppressed(e)
+	}
+}
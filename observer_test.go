@@ -0,0 +1,126 @@
+package ms
+
+import (
+	"errors"
+	"github.com/cevatbarisyilmaz/ms/smtp"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type recordingObserver struct {
+	NopObserver
+	attempts   []*Event
+	delivered  []*Event
+	deferred   []*Event
+	bounced    []*Event
+	suppressed []*Event
+	// order is the names of the callbacks in the order they are called
+	order []string
+}
+
+func (o *recordingObserver) Attempt(e *Event) {
+	o.attempts = append(o.attempts, e)
+	o.order = append(o.order, "attempt")
+}
+
+func (o *recordingObserver) Delivered(e *Event) {
+	o.delivered = append(o.delivered, e)
+	o.order = append(o.order, "delivered")
+}
+
+func (o *recordingObserver) Deferred(e *Event) {
+	o.deferred = append(o.deferred, e)
+	o.order = append(o.order, "deferred")
+}
+
+func (o *recordingObserver) Bounced(e *Event) {
+	o.bounced = append(o.bounced, e)
+	o.order = append(o.order, "bounced")
+}
+
+func (o *recordingObserver) Suppressed(e *Event) {
+	o.suppressed = append(o.suppressed, e)
+	o.order = append(o.order, "suppressed")
+}
+
+func TestService_observeResult(t *testing.T) {
+	observer := &recordingObserver{}
+	s := &Service{Observer: observer, RetryDelay: time.Hour}
+	d := &delivery{messageID: "<1@example.org>"}
+	rejection := &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	s.observeResult(d, &Result{
+		Recipient: "joe@example.com",
+		Status:    Failed,
+		MX:        "mx1.example.com",
+		Err:       rejection,
+		Attempts: []*Attempt{
+			{MX: "mx1.example.com", IP: net.ParseIP("2001:db8::1"), Err: errors.New("connection refused")},
+			{MX: "mx1.example.com", IP: net.ParseIP("192.0.2.1"), Err: rejection},
+		},
+	})
+	s.observeResult(d, &Result{
+		Recipient: "jane@example.com",
+		Status:    Deferred,
+		MX:        "mx1.example.com",
+		Err:       &smtp.SMTPError{Code: 451, Message: "Try again later"},
+	})
+	s.observeResult(d, &Result{Recipient: "bob@example.com", Status: Delivered, MX: "mx1.example.com"})
+	s.observeResult(d, &Result{Recipient: "ann@example.com", Status: Suppressed, Err: ErrSuppressed})
+
+	// The attempts are reported as they happen rather than with the outcome
+	if len(observer.attempts) != 0 {
+		t.Fatal("Attempts are reported again:", observer.attempts)
+	}
+	if len(observer.bounced) != 1 {
+		t.Fatal("Invalid bounced events:", observer.bounced)
+	}
+	bounced := observer.bounced[0]
+	if bounced.MessageID != "<1@example.org>" || bounced.Recipient != "joe@example.com" || bounced.MX != "mx1.example.com" || bounced.Response != rejection {
+		t.Errorf("Invalid bounced event: %+v", bounced)
+	}
+	if len(observer.deferred) != 1 || observer.deferred[0].Response == nil || observer.deferred[0].RetryAt.Sub(observer.deferred[0].Time) != time.Hour {
+		t.Fatal("Invalid deferred events:", observer.deferred)
+	}
+	if len(observer.delivered) != 1 || observer.delivered[0].Recipient != "bob@example.com" || observer.delivered[0].Response != nil {
+		t.Fatal("Invalid delivered events:", observer.delivered)
+	}
+	if len(observer.suppressed) != 1 || observer.suppressed[0].Recipient != "ann@example.com" || observer.suppressed[0].Err != ErrSuppressed {
+		t.Fatal("Invalid suppressed events:", observer.suppressed)
+	}
+}
+
+func TestService_observeAttempt(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	observer := &recordingObserver{}
+	s := newTestService(t)
+	s.Observer = observer
+	s.Transport = &RelayTransport{Addr: addr}
+	s.Suppressions = NewMemorySuppressionStore()
+	err = s.Suppressions.Add(&Suppression{Recipient: "ann@example.com", Reason: SuppressionComplaint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Deliver(&Mail{
+		Headers: map[string][]byte{
+			"From": []byte("joe@example.org"),
+			"To":   []byte("jane@example.com, ann@example.com"),
+		},
+		Body: []byte("Hello"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(observer.order, []string{"suppressed", "attempt", "deferred"}) {
+		t.Fatal("Invalid events:", observer.order)
+	}
+	if attempt := observer.attempts[0]; attempt.Recipient != "jane@example.com" || attempt.MX != "127.0.0.1" || attempt.Err == nil {
+		t.Errorf("Invalid attempt event: %+v", attempt)
+	}
+}
@@ -0,0 +1,291 @@
+package ms
+
+import (
+	"github.com/cevatbarisyilmaz/ms/smtp"
+	"github.com/pkg/errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrThrottled is reported for the deliveries that are deferred without connecting since
+// the destination kept throttling the service
+var ErrThrottled = errors.New("destination is throttling, delivery is paused")
+
+// ErrRateLimited is reported for the deliveries that are deferred without connecting since
+// they would wait longer than Limiter.MaxWait for the rate of the destination
+var ErrRateLimited = errors.New("destination rate limit is reached, delivery is deferred")
+
+// throttledRate is the rate in messages per second the unlimited destinations slow down to once they throttle
+const throttledRate = 1
+
+// bucketIdle is how long the state of a destination is kept after its last delivery
+const bucketIdle = 10 * time.Minute
+
+// RateLimit is a token bucket limit for a single destination
+type RateLimit struct {
+	// Rate is the number of messages per second, 0 means unlimited
+	Rate float64
+	// Burst is the number of messages that can be sent at once, values less than 1 are treated as 1
+	Burst int
+	// MaxConnections is the number of concurrent connections, 0 means unlimited
+	MaxConnections int
+}
+
+// Limiter limits the outbound mails per destination domain and per MX host
+// Throttling replies of remote SMTP servers (421 and 4.7.x) halve the rate of the destination down to MinRate,
+// it recovers gradually with the deliveries that aren't throttled
+// The destinations without deliveries for 10 minutes are forgotten
+// The zero value is a Limiter without any rate limits that never pauses the destinations
+type Limiter struct {
+	// Domain is the limit of each recipient domain that is not in Domains
+	Domain RateLimit
+	// Domains are the limits of specific recipient domains such as "gmail.com"
+	Domains map[string]RateLimit
+	// Host is the limit of each MX host that is not in Hosts
+	Host RateLimit
+	// Hosts are the limits of specific MX hosts such as "gmail-smtp-in.l.google.com"
+	Hosts map[string]RateLimit
+	// PauseAfter is the number of consecutive throttling replies that pause the destination, 0 means never
+	PauseAfter int
+	// Pause is the duration the deliveries to a paused destination are deferred without connecting
+	Pause time.Duration
+	// MinRate is the lowest rate in messages per second throttling slows a destination down to
+	// Values less than or equal to 0 are treated as 1 message per minute
+	MinRate float64
+	// MaxWait is the longest a delivery waits for the rate of its destination, the ones that would wait longer
+	// are deferred with ErrRateLimited without connecting
+	// Values less than or equal to 0 are treated as 1 minute
+	MaxWait time.Duration
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buckets map[string]*bucket
+	pruned  time.Time
+}
+
+// NewLimiter returns a Limiter without any rate limits that pauses the destinations
+// for 5 minutes after 3 consecutive throttling replies
+func NewLimiter() *Limiter {
+	return &Limiter{
+		Domains:    map[string]RateLimit{},
+		Hosts:      map[string]RateLimit{},
+		PauseAfter: 3,
+		Pause:      5 * time.Minute,
+	}
+}
+
+type bucket struct {
+	limit RateLimit
+	// rate is the current rate, it is lower than the limit after throttling, 0 means unlimited
+	rate        float64
+	tokens      float64
+	last        time.Time
+	conns       int
+	throttles   int
+	pausedUntil time.Time
+	// used is the last time a delivery to the destination is started or finished
+	used time.Time
+}
+
+func (b *bucket) burst() float64 {
+	if b.limit.Burst < 1 {
+		return 1
+	}
+	return float64(b.limit.Burst)
+}
+
+// reserve takes a token and returns how long to wait for it
+func (b *bucket) reserve(now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst() {
+		b.tokens = b.burst()
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel gives back the token taken by reserve
+func (b *bucket) cancel() {
+	if b.rate > 0 {
+		b.tokens++
+	}
+}
+
+func (b *bucket) connAvailable() bool {
+	return b.limit.MaxConnections <= 0 || b.conns < b.limit.MaxConnections
+}
+
+// lazyInit prepares the state of a zero Limiter, it must be called with mu held
+func (l *Limiter) lazyInit() {
+	if l.buckets == nil {
+		l.buckets = map[string]*bucket{}
+		l.cond = sync.NewCond(&l.mu)
+	}
+}
+
+func (l *Limiter) bucket(key string, limit RateLimit, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{
+			limit:  limit,
+			rate:   limit.Rate,
+			tokens: 1,
+			last:   now,
+		}
+		if limit.Burst > 1 {
+			b.tokens = float64(limit.Burst)
+		}
+		l.buckets[key] = b
+	}
+	b.used = now
+	return b
+}
+
+// prune forgets the idle destinations, so the buckets of the domains that aren't mailed anymore don't pile up
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < bucketIdle {
+		return
+	}
+	l.pruned = now
+	for key, b := range l.buckets {
+		if b.conns == 0 && now.Sub(b.used) >= bucketIdle && !now.Before(b.pausedUntil) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *Limiter) minRate() float64 {
+	if l.MinRate <= 0 {
+		return 1.0 / 60
+	}
+	return l.MinRate
+}
+
+func (l *Limiter) maxWait() time.Duration {
+	if l.MaxWait <= 0 {
+		return time.Minute
+	}
+	return l.MaxWait
+}
+
+func (l *Limiter) destination(domain string, host string, now time.Time) (*bucket, *bucket) {
+	domain = strings.ToLower(domain)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	domainLimit, ok := l.Domains[domain]
+	if !ok {
+		domainLimit = l.Domain
+	}
+	hostLimit, ok := l.Hosts[host]
+	if !ok {
+		hostLimit = l.Host
+	}
+	return l.bucket("domain:"+domain, domainLimit, now), l.bucket("host:"+host, hostLimit, now)
+}
+
+// acquire waits until a message can be sent to the MX host of the domain
+// It fails with ErrRateLimited instead of waiting longer than MaxWait for the rate
+// The returned function must be called once the connection is closed
+func (l *Limiter) acquire(domain string, host string) (func(), error) {
+	l.mu.Lock()
+	l.lazyInit()
+	now := time.Now()
+	l.prune(now)
+	domainBucket, hostBucket := l.destination(domain, host, now)
+	if now.Before(domainBucket.pausedUntil) || now.Before(hostBucket.pausedUntil) {
+		l.mu.Unlock()
+		return nil, ErrThrottled
+	}
+	wait := domainBucket.reserve(now)
+	if hostWait := hostBucket.reserve(now); hostWait > wait {
+		wait = hostWait
+	}
+	if wait > l.maxWait() {
+		domainBucket.cancel()
+		hostBucket.cancel()
+		l.mu.Unlock()
+		return nil, ErrRateLimited
+	}
+	l.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	l.mu.Lock()
+	for !domainBucket.connAvailable() || !hostBucket.connAvailable() {
+		l.cond.Wait()
+	}
+	domainBucket.conns++
+	hostBucket.conns++
+	l.mu.Unlock()
+	return func() {
+		l.mu.Lock()
+		domainBucket.conns--
+		hostBucket.conns--
+		l.mu.Unlock()
+		l.cond.Broadcast()
+	}, nil
+}
+
+// observe adjusts the rates of the destination according to the outcome of a delivery
+func (l *Limiter) observe(domain string, host string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lazyInit()
+	now := time.Now()
+	domainBucket, hostBucket := l.destination(domain, host, now)
+	throttled := isThrottling(err)
+	for _, b := range []*bucket{domainBucket, hostBucket} {
+		switch {
+		case throttled:
+			if b.rate <= 0 {
+				b.rate = throttledRate
+			} else {
+				b.rate /= 2
+			}
+			if b.rate < l.minRate() {
+				b.rate = l.minRate()
+			}
+			b.throttles++
+			if l.PauseAfter > 0 && b.throttles >= l.PauseAfter {
+				b.throttles = 0
+				b.pausedUntil = now.Add(l.Pause)
+			}
+		default:
+			// Failures other than throttling, such as rejected recipients, don't stop the recovery
+			b.throttles = 0
+			if b.rate <= 0 {
+				continue
+			}
+			if b.limit.Rate <= 0 {
+				b.rate += throttledRate / 10.0
+				if b.rate >= throttledRate*10 {
+					b.rate = 0
+				}
+			} else if b.rate < b.limit.Rate {
+				b.rate += b.limit.Rate / 10
+				if b.rate > b.limit.Rate {
+					b.rate = b.limit.Rate
+				}
+			}
+		}
+	}
+}
+
+// isThrottling reports whether the error is a reply asking the client to slow down
+func isThrottling(err error) bool {
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		return false
+	}
+	if smtpErr.Code == 421 {
+		return true
+	}
+	return smtpErr.Code/100 == 4 && smtpErr.EnhancedCode[0] == 4 && smtpErr.EnhancedCode[1] == 7
+}
@@ -0,0 +1,160 @@
+package ms
+
+import (
+	"github.com/cevatbarisyilmaz/ms/smtp"
+	"testing"
+	"time"
+)
+
+func TestLimiter_rate(t *testing.T) {
+	l := NewLimiter()
+	l.Domains["example.com"] = RateLimit{Rate: 20}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		release, err := l.acquire("example.com", "mx.example.com.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Error("Rate limit is not applied, elapsed:", elapsed)
+	}
+}
+
+func TestLimiter_zero(t *testing.T) {
+	var l Limiter
+	l.Host = RateLimit{MaxConnections: 1}
+	release, err := l.acquire("example.com", "mx.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.observe("example.com", "mx.example.com", nil)
+	release()
+	l.observe("example.org", "mx.example.org", &smtp.SMTPError{Code: 421, Message: "Slow down"})
+	if _, hostBucket := l.destination("example.org", "mx.example.org", time.Now()); hostBucket.rate != throttledRate {
+		t.Error("Zero limiter doesn't slow down:", hostBucket.rate)
+	}
+}
+
+func TestLimiter_throttling(t *testing.T) {
+	l := NewLimiter()
+	l.Domain = RateLimit{Rate: 8}
+	throttling := &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: "Slow down"}
+
+	l.observe("example.com", "mx.example.com", throttling)
+	domainBucket, hostBucket := l.destination("example.com", "mx.example.com", time.Now())
+	if domainBucket.rate != 4 {
+		t.Error("Domain rate is not halved:", domainBucket.rate)
+	}
+	if hostBucket.rate != throttledRate {
+		t.Error("Unlimited host is not slowed down:", hostBucket.rate)
+	}
+
+	l.observe("example.com", "mx.example.com", nil)
+	if domainBucket.rate <= 4 {
+		t.Error("Domain rate is not recovering:", domainBucket.rate)
+	}
+
+	l.observe("example.com", "mx.example.com", throttling)
+	l.observe("example.com", "mx.example.com", throttling)
+	l.observe("example.com", "mx.example.com", throttling)
+	if _, err := l.acquire("example.com", "mx2.example.com"); err != ErrThrottled {
+		t.Error("Throttling domain is not paused:", err)
+	}
+
+	l.observe("example.org", "mx.example.org", &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Blocked"})
+	domainBucket, _ = l.destination("example.org", "mx.example.org", time.Now())
+	if domainBucket.rate != 8 {
+		t.Error("Permanent failure is treated as throttling:", domainBucket.rate)
+	}
+}
+
+func TestLimiter_connections(t *testing.T) {
+	l := NewLimiter()
+	l.Host = RateLimit{MaxConnections: 1}
+	release, err := l.acquire("example.com", "mx.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan struct{})
+	go func() {
+		release, err := l.acquire("example.net", "mx.example.com")
+		if err == nil {
+			release()
+		}
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Connection limit is not applied")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("Connection is not released")
+	}
+}
+
+func TestLimiter_minRate(t *testing.T) {
+	l := NewLimiter()
+	l.PauseAfter = 0
+	l.MinRate = 0.5
+	throttling := &smtp.SMTPError{Code: 421, EnhancedCode: smtp.EnhancedCode{4, 7, 0}, Message: "Try again later"}
+	for i := 0; i < 10; i++ {
+		l.observe("example.com", "mx.example.com", throttling)
+	}
+	domainBucket, _ := l.destination("example.com", "mx.example.com", time.Now())
+	if domainBucket.rate != 0.5 {
+		t.Error("Rate is not bounded:", domainBucket.rate)
+	}
+
+	// Failures other than throttling don't stop the recovery
+	l.observe("example.com", "mx.example.com", &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"})
+	if domainBucket.rate <= 0.5 {
+		t.Error("Rate is not recovering:", domainBucket.rate)
+	}
+}
+
+func TestLimiter_maxWait(t *testing.T) {
+	l := NewLimiter()
+	l.Domain = RateLimit{Rate: 1}
+	l.MaxWait = 100 * time.Millisecond
+	release, err := l.acquire("example.com", "mx.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	start := time.Now()
+	if _, err := l.acquire("example.com", "mx.example.com"); err != ErrRateLimited {
+		t.Error("Long wait is not deferred:", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Error("Deferred delivery waited:", elapsed)
+	}
+	domainBucket, _ := l.destination("example.com", "mx.example.com", time.Now())
+	if domainBucket.tokens < -0.1 {
+		t.Error("Token of the deferred delivery is not given back:", domainBucket.tokens)
+	}
+}
+
+func TestLimiter_prune(t *testing.T) {
+	l := NewLimiter()
+	release, err := l.acquire("example.com", "mx.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if _, err := l.acquire("example.net", "mx.example.net"); err != nil {
+		t.Fatal(err)
+	}
+	l.prune(time.Now().Add(bucketIdle))
+	if len(l.buckets) != 2 {
+		t.Error("Invalid buckets after pruning:", len(l.buckets))
+	}
+	if _, ok := l.buckets["host:mx.example.net"]; !ok {
+		t.Error("Bucket in use is pruned")
+	}
+}
@@ -0,0 +1,119 @@
+package ms
+
+import (
+	"github.com/cevatbarisyilmaz/ms/smtp"
+	"net"
+	"time"
+)
+
+// Status is the delivery status of a single recipient
+type Status int
+
+const (
+	// Delivered means a remote SMTP server accepted the mail for the recipient
+	Delivered Status = iota
+	// Deferred means the delivery failed temporarily and may succeed if tried later
+	Deferred
+	// Failed means the delivery failed permanently
+	Failed
+	// Suppressed means the recipient is skipped since it is in the suppression list
+	Suppressed
+)
+
+func (s Status) String() string {
+	switch s {
+	case Delivered:
+		return "delivered"
+	case Deferred:
+		return "deferred"
+	case Failed:
+		return "failed"
+	case Suppressed:
+		return "suppressed"
+	}
+	return "unknown"
+}
+
+// Attempt is a single connection attempt to an address of an MX host
+type Attempt struct {
+	// MX is the host name of the remote SMTP server
+	MX string
+	// IP is the address of the MX host, it is nil if the host couldn't be resolved
+	IP net.IP
+	// LocalIP is the source address of the connection, it is nil if no IP pool is used
+	LocalIP net.IP
+	// Err is the cause of the failure, it is nil for the attempt that delivered the mail
+	Err error
+	// Rejected reports whether Err is a reply to the recipient itself, to its RCPT command or its LMTP status,
+	// rather than a failure of the whole mail such as a rejected sender
+	Rejected bool
+	// Transcript is the SMTP conversation of the attempt if Service.Transcripts is set
+	Transcript string
+}
+
+// Result holds the outcome of the delivery for a single recipient
+type Result struct {
+	// Recipient is the email address of the recipient without the display name
+	Recipient string
+	Status    Status
+	// MX is the host name of the remote SMTP server that accepted or rejected the mail
+	// It is empty if no SMTP server is reached
+	MX string
+	// Err is the cause of the failure, it is nil for delivered recipients
+	// It is of type *smtp.SMTPError if the remote SMTP server rejected the mail
+	Err error
+	// Rejected reports whether Err is a reply to the recipient itself, to its RCPT command or its LMTP status,
+	// rather than a failure of the whole mail such as a rejected sender
+	Rejected bool
+	// Attempts are the connection attempts made for the recipient in order
+	Attempts []*Attempt
+}
+
+// Report is the detailed outcome of a Deliver call
+type Report struct {
+	// MessageID is the Message-ID header assigned to the mail
+	MessageID string
+	// Pool is the name of the IP pool the mail is sent from, it is empty if no pool is used
+	Pool string
+	// Recipients maps the email addresses to the results
+	Recipients map[string]*Result
+	// Arrival is the time the mail is submitted for delivery
+	Arrival time.Time
+	// Bounce is the report of the delivery status notification sent to the sender if any
+	Bounce *Report
+	// BounceErr is the reason the delivery status notification couldn't be sent if any
+	BounceErr error
+}
+
+// Errors returns a recipient to error map for the failed recipients
+func (r *Report) Errors() map[string]error {
+	errs := map[string]error{}
+	for recipient, result := range r.Recipients {
+		if result.Err != nil {
+			errs[recipient] = result.Err
+		}
+	}
+	return errs
+}
+
+// failed reports whether a recipient failed permanently
+func (r *Report) failed() bool {
+	for _, result := range r.Recipients {
+		if result.Status == Failed {
+			return true
+		}
+	}
+	return false
+}
+
+// statusOf classifies a delivery error
+// Only rejections with 5yz replies are considered as permanent failures
+func statusOf(err error) Status {
+	if err == nil {
+		return Delivered
+	}
+	if smtpErr, ok := err.(*smtp.SMTPError); ok && smtpErr.Code/100 == 5 {
+		return Failed
+	}
+	return Deferred
+}
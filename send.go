@@ -3,10 +3,10 @@ package ms
 
 import (
 	"bytes"
-	"context"
 	"crypto"
 	"github.com/cevatbarisyilmaz/ms/smtp"
 	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-sasl"
 	"github.com/pkg/errors"
 	"io"
 	"math/rand"
@@ -22,11 +22,77 @@ const timeout = time.Second * 8
 
 // Service is used to send mails
 type Service struct {
+	// Bounces enables delivery status notifications (RFC 3464)
+	// If set, the sender of a mail is notified about the recipients that failed permanently
+	Bounces bool
+	// VERP enables Variable Envelope Return Paths
+	// If set, the envelope sender of each delivery encodes the recipient, see VERP and DecodeVERP
+	// The senders with + in their local parts are used as they are
+	VERP bool
+	// Suppressions is the list of recipients to skip
+	// If set, recipients that fail permanently with 5.1.x status codes are added to it automatically
+	Suppressions SuppressionStore
+	// SuppressionTTL is the duration of the automatically added suppressions, 0 means forever
+	SuppressionTTL time.Duration
+	// Limiter limits the rate of the deliveries per destination if set
+	Limiter *Limiter
+	// Pools are the named IP pools to send mails from
+	Pools map[string]*IPPool
+	// Pool is the name of the IP pool to send mails from unless Mail.Pool is set
+	// If both are empty, the local address is picked by the operating system
+	Pool string
+	// Resolver is used for DNS lookups, net.DefaultResolver is used if it is nil
+	Resolver Resolver
+	// Family is the address family to connect to the MX hosts with unless the destination is in Families
+	Family AddressFamily
+	// Families are the address families of specific recipient domains such as "gmail.com"
+	Families map[string]AddressFamily
+	// Port is the port to connect to the MX hosts on, 25 is used if it is empty
+	Port string
+	// Observer is notified about the lifecycle of the deliveries if set
+	Observer Observer
+	// RetryDelay is the suggested delay for retrying deferred deliveries reported to the Observer
+	// 15 minutes is used if it is 0
+	RetryDelay time.Duration
+	// Metrics collects the measurements of the service if set, see PrometheusMetrics
+	Metrics Metrics
+	// BccHeader makes each Bcc recipient receive a copy with a Bcc header holding its own address
+	// Such copies are signed and sent separately, the Bcc recipients don't see any Bcc header if it is false
+	BccHeader bool
+	// Unsubscriber adds one-click unsubscribe headers to the mails with a single recipient if set
+	Unsubscriber *Unsubscriber
+	// Transport transmits the signed mails, they are sent directly to the MX hosts of the recipients if it is nil
+	// See RelayTransport, LMTPTransport, DirTransport and MemoryTransport for the alternatives
+	// ParseTransport picks one from a URL, so the transport can be set by the configuration of each environment
+	Transport Transport
+	// Transcripts enables attaching the SMTP conversations to the attempts in the reports
+	Transcripts bool
+	// Transcript receives the SMTP conversations of all deliveries as they happen if set
+	// Each line is prefixed with the Message-ID, the comma separated recipients and the address of the MX host
+	Transcript io.Writer
+
 	domain          string
 	dkimSignOptions *dkim.SignOptions
 	nextMessageID   uint16
 	nextMessageIDMu *sync.Mutex
 	rand            *rand.Rand
+	hostnames       map[string]string
+	hostnamesMu     *sync.Mutex
+	transcriptMu    sync.Mutex
+	// queued is the number of recipients waiting for delivery
+	queued int32
+}
+
+// delivery holds the state of a single mail being delivered
+type delivery struct {
+	messageID string
+	// sender is the envelope sender, an empty sender is the null reverse-path
+	sender string
+	pool   *IPPool
+	// signed reports whether the mail is signed by the service
+	signed bool
+	// downgraded is the mail converted to 7-bit for the servers without 8BITMIME once it is needed
+	downgraded []byte
 }
 
 // New returns a new Service to send emails via
@@ -47,6 +113,8 @@ func New(domain string, dkimSelector string, dkimSigner crypto.Signer) *Service
 		nextMessageID:   uint16(serviceRand.Intn(16)) + 1,
 		nextMessageIDMu: &sync.Mutex{},
 		rand:            serviceRand,
+		hostnames:       map[string]string{},
+		hostnamesMu:     &sync.Mutex{},
 	}
 }
 
@@ -58,146 +126,431 @@ func New(domain string, dkimSelector string, dkimSigner crypto.Signer) *Service
 // someuser@somedomain.com
 // a 0 length report and nil error means everything went okay
 func (s *Service) Send(m *Mail) (map[string]error, error) {
-	s.nextMessageIDMu.Lock()
-	msgID := s.nextMessageID
-	s.nextMessageID += uint16(s.rand.Intn(16))
-	s.nextMessageIDMu.Unlock()
-	m.Headers["Message-ID"] = []byte("<" + strconv.Itoa(int(time.Now().Unix())) + "." + strconv.Itoa(rand.Int()) + "." + strconv.Itoa(int(msgID)) + "@" + s.domain + ">")
+	report, err := s.Deliver(m)
+	if err != nil {
+		return nil, err
+	}
+	return report.Errors(), nil
+}
+
+// Deliver sends the mail to a remote SMTP server like Send does
+// but returns a detailed report of the delivery for each recipient
+// The mail is not modified, the Message-ID and other headers are added to a copy of it
+func (s *Service) Deliver(m *Mail) (*Report, error) {
+	return s.deliverFrom(m, deliverOptions{sign: true})
+}
+
+// SendRaw delivers a pre-built mail such as the ones read with ReadMail like Deliver does
+// The mail is sent as it is, except that the Bcc header is removed and a Message-ID is added if it is missing
+// If resign is set, the DKIM signatures of the mail are removed and it is signed with the key of the service
+// It should be set unless the mail is signed already and isn't modified since then
+func (s *Service) SendRaw(m *Mail, resign bool) (*Report, error) {
+	return s.deliverFrom(m, deliverOptions{prebuilt: true, sign: resign})
+}
+
+// deliverOptions tell deliver how to prepare a mail
+type deliverOptions struct {
+	// prebuilt keeps the Message-ID of the mail and doesn't add any other headers
+	prebuilt bool
+	// sign signs the mail after removing the DKIM signatures it has
+	sign bool
+}
+
+// deliverFrom delivers a copy of the mail with the From header as the envelope sender
+func (s *Service) deliverFrom(m *Mail, opts deliverOptions) (*Report, error) {
 	from, err := mail.ParseAddress(string(m.Headers["From"]))
 	if err != nil {
 		return nil, errors.Wrap(err, "parsing from header failed")
 	}
-	var to []string
-	addrs, err := mail.ParseAddressList(string(m.Headers["To"]))
-	if err == nil {
-		for _, addr := range addrs {
-			to = append(to, addr.Address)
-		}
+	m = m.clone()
+	report, err := s.deliver(m, from.Address, opts)
+	if err != nil {
+		return nil, err
 	}
-	addrs, err = mail.ParseAddressList(string(m.Headers["Cc"]))
-	if err == nil {
-		for _, addr := range addrs {
-			to = append(to, addr.Address)
-		}
+	if s.Bounces {
+		report.Bounce, report.BounceErr = s.bounce(m, from.Address, report)
+	}
+	return report, nil
+}
+
+// deliver sends the mail with the given envelope sender, an empty sender is the null reverse-path
+// The headers of the mail are modified, the caller must pass a mail it owns
+func (s *Service) deliver(m *Mail, sender string, opts deliverOptions) (*Report, error) {
+	arrival := time.Now()
+	pool, ok := s.pool(m.Pool)
+	if !ok {
+		return nil, errors.New("unknown IP pool")
+	}
+	messageID := string(m.Headers["Message-ID"])
+	if !opts.prebuilt || messageID == "" {
+		messageID = s.newMessageID()
+		m.Headers["Message-ID"] = []byte(messageID)
+	}
+	d := &delivery{
+		messageID: messageID,
+		sender:    sender,
+		pool:      pool,
+		signed:    opts.sign,
 	}
+	seen := map[string]bool{}
+	var to []string
 	var bcc []*mail.Address
-	addrs, err = mail.ParseAddressList(string(m.Headers["Bcc"]))
-	if err == nil {
+	for _, key := range []string{"To", "Cc", "Bcc"} {
+		addrs, err := mail.ParseAddressList(string(m.Headers[key]))
+		if err != nil {
+			continue
+		}
 		for _, addr := range addrs {
-			bcc = append(bcc, addr)
+			// A recipient listed more than once gets a single copy
+			if seen[strings.ToLower(addr.Address)] {
+				continue
+			}
+			seen[strings.ToLower(addr.Address)] = true
+			if key == "Bcc" {
+				bcc = append(bcc, addr)
+			} else {
+				to = append(to, addr.Address)
+			}
 		}
 	}
 	if len(to) == 0 && len(bcc) == 0 {
 		return nil, errors.New("either To, Cc, or Bcc must be supplied")
 	}
 	delete(m.Headers, "Bcc")
-	report := map[string]error{}
-	if len(to) > 0 {
-		signer, err := dkim.NewSigner(s.dkimSignOptions)
-		if err != nil {
-			return nil, err
+	if opts.sign {
+		delete(m.Headers, "DKIM-Signature")
+	}
+	if !opts.prebuilt && s.Unsubscriber != nil && sender != "" && len(to)+len(bcc) == 1 && m.Headers["List-Unsubscribe"] == nil {
+		recipient := ""
+		if len(to) == 1 {
+			recipient = to[0]
+		} else {
+			recipient = bcc[0].Address
 		}
-		rawMail := m.encode()
-		_, err = signer.Write(rawMail)
-		if err != nil {
-			return nil, err
+		// The headers are added before signing, so they are covered by the DKIM signature as RFC 8058 requires
+		for key, value := range s.Unsubscriber.Headers(recipient) {
+			m.Headers[key] = value
 		}
-		err = signer.Close()
+	}
+	recipients := to
+	if !s.BccHeader {
+		for _, recipient := range bcc {
+			recipients = append(recipients, recipient.Address)
+		}
+	}
+	var rawMail []byte
+	if len(recipients) > 0 {
+		var err error
+		rawMail, err = s.prepare(m, opts.sign)
 		if err != nil {
 			return nil, err
 		}
-		var buffer bytes.Buffer
-		buffer.WriteString(signer.Signature())
-		buffer.Write(rawMail)
-		reader := bytes.NewReader(buffer.Bytes())
-		for _, recipient := range to {
-			addr, err := resolveAddr(recipient)
+	}
+	s.observeAccepted(d)
+	s.measureMessage(len(to) + len(bcc))
+	report := &Report{
+		MessageID:  messageID,
+		Arrival:    arrival,
+		Recipients: map[string]*Result{},
+	}
+	if pool != nil {
+		report.Pool = pool.Name
+	}
+	for _, result := range s.deliverTo(d, rawMail, recipients) {
+		report.Recipients[result.Recipient] = result
+	}
+	if s.BccHeader {
+		for _, recipient := range bcc {
+			m.Headers["Bcc"] = []byte(recipient.String())
+			rawMail, err := s.prepare(m, opts.sign)
 			if err != nil {
-				report[recipient] = err
+				result := &Result{Recipient: recipient.Address, Status: Failed, Err: err}
+				s.observeResult(d, result)
+				s.measureResult(result)
+				report.Recipients[recipient.Address] = result
 				continue
 			}
-			ctx, _ := context.WithTimeout(context.Background(), timeout)
-			mxs, err := net.DefaultResolver.LookupMX(ctx, addr)
-			if err != nil || len(mxs) == 0 {
-				mxs = []*net.MX{{Host: addr}}
+			for _, result := range s.deliverTo(d, rawMail, []string{recipient.Address}) {
+				report.Recipients[result.Recipient] = result
 			}
-			var firstError error
-			for _, mx := range mxs {
-				_, err = reader.Seek(0, io.SeekStart)
-				if err != nil {
-					report[recipient] = err
-					break
-				}
-				err = smtp.SendMail(mx.Host+":smtp", nil, from.Address, []string{recipient}, reader, s.domain)
-				if err == nil {
-					firstError = nil
-					break
-				}
-				if firstError == nil {
-					firstError = err
-				}
+		}
+		delete(m.Headers, "Bcc")
+	}
+	return report, nil
+}
+
+func (s *Service) newMessageID() string {
+	s.nextMessageIDMu.Lock()
+	msgID := s.nextMessageID
+	s.nextMessageID += uint16(s.rand.Intn(16))
+	s.nextMessageIDMu.Unlock()
+	return "<" + strconv.Itoa(int(time.Now().Unix())) + "." + strconv.Itoa(rand.Int()) + "." + strconv.Itoa(int(msgID)) + "@" + s.domain + ">"
+}
+
+// prepare returns the encoded mail, it is signed if sign is set
+func (s *Service) prepare(m *Mail, sign bool) ([]byte, error) {
+	if !sign {
+		return m.encode(), nil
+	}
+	return s.sign(m)
+}
+
+// sign returns the encoded mail prefixed with its DKIM signature
+func (s *Service) sign(m *Mail) ([]byte, error) {
+	if s.Metrics != nil {
+		defer func(start time.Time) {
+			s.Metrics.SigningTime(time.Since(start))
+		}(time.Now())
+	}
+	signer, err := dkim.NewSigner(s.dkimSignOptions)
+	if err != nil {
+		return nil, err
+	}
+	rawMail := m.encode()
+	_, err = signer.Write(rawMail)
+	if err != nil {
+		return nil, err
+	}
+	err = signer.Close()
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString(signer.Signature())
+	buffer.Write(rawMail)
+	return buffer.Bytes(), nil
+}
+
+// deliverTo delivers the mail to the recipients that aren't suppressed through the transport
+// The recipients are handed over together, so the transport can batch the ones in the same domain
+// unless VERP gives each of them a different envelope sender
+func (s *Service) deliverTo(d *delivery, data []byte, recipients []string) []*Result {
+	results := make([]*Result, 0, len(recipients))
+	var batch []string
+	for _, recipient := range recipients {
+		if s.suppressed(recipient) {
+			result := &Result{Recipient: recipient, Status: Suppressed, Err: ErrSuppressed}
+			s.observeResult(d, result)
+			s.measureResult(result)
+			results = append(results, result)
+			continue
+		}
+		batch = append(batch, recipient)
+	}
+	if len(batch) == 0 {
+		return results
+	}
+	var sent []*Result
+	if s.VERP && d.sender != "" {
+		for _, recipient := range batch {
+			// The ASCII form of the domain keeps the sender ASCII unless the local part of the recipient isn't
+			encoded, err := envelopeAddr(recipient)
+			if err != nil {
+				encoded = recipient
 			}
-			if firstError != nil {
-				report[recipient] = firstError
+			sent = append(sent, s.transport().Send(&Envelope{
+				MessageID:  d.messageID,
+				Sender:     VERP(d.sender, encoded),
+				Recipients: []string{recipient},
+				Pool:       d.pool,
+				service:    s,
+				signed:     d.signed,
+			}, data)...)
+		}
+	} else {
+		sent = s.transport().Send(&Envelope{
+			MessageID:  d.messageID,
+			Sender:     d.sender,
+			Recipients: batch,
+			Pool:       d.pool,
+			service:    s,
+			signed:     d.signed,
+		}, data)
+	}
+	for _, result := range sent {
+		s.suppressFailure(result)
+		s.observeResult(d, result)
+		s.measureResult(result)
+	}
+	return append(results, sent...)
+}
+
+// sendMail sends the mail to a single MX host within the limits of the service
+// It returns the attempts and the error of each recipient in the order of the recipients
+func (s *Service) sendMail(d *delivery, domain string, host string, sender string, recipients []string, data []byte) ([][]*Attempt, []error) {
+	if s.Limiter != nil {
+		release, err := s.Limiter.acquire(domain, host)
+		if err != nil {
+			attempts := make([][]*Attempt, len(recipients))
+			for i := range attempts {
+				attempts[i] = []*Attempt{{MX: strings.TrimSuffix(host, "."), Err: err}}
+				s.observeAttempt(d, recipients[i], attempts[i][0])
 			}
+			return attempts, sameErrors(len(recipients), err)
 		}
+		defer release()
 	}
-	if len(bcc) > 0 {
-		for _, recipient := range bcc {
-			signer, err := dkim.NewSigner(s.dkimSignOptions)
-			if err != nil {
-				report[recipient.Address] = err
-				continue
+	attempts, errs := s.send(d, domain, host, sender, recipients, data)
+	if s.Limiter != nil {
+		s.Limiter.observe(domain, host, batchErr(errs))
+	}
+	return attempts, errs
+}
+
+// batchErr returns the error telling the most about the destination among the errors of the recipients
+// Throttling errors come first, it is nil if all recipients are accepted
+func batchErr(errs []error) error {
+	var first error
+	for _, err := range errs {
+		if isThrottling(err) {
+			return err
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// send tries the addresses of the MX host until the mail is transmitted or rejected permanently for all recipients
+// The recipients that are deferred by an address are tried again with the next one
+func (s *Service) send(d *delivery, domain string, host string, sender string, recipients []string, data []byte) ([][]*Attempt, []error) {
+	mx := strings.TrimSuffix(host, ".")
+	attempts := make([][]*Attempt, len(recipients))
+	errs := make([]error, len(recipients))
+	ips, err := s.lookupIP(domain, host)
+	if err != nil {
+		for i := range attempts {
+			attempts[i] = []*Attempt{{MX: mx, Err: err}}
+			s.observeAttempt(d, recipients[i], attempts[i][0])
+		}
+		return attempts, sameErrors(len(recipients), err)
+	}
+	pending := make([]int, len(recipients))
+	for i := range pending {
+		pending[i] = i
+	}
+	for len(ips) > 0 && len(pending) > 0 {
+		conn, ip, source, failed, rest := s.dial(d, mx, ips, s.port())
+		for _, i := range pending {
+			attempts[i] = append(attempts[i], failed...)
+			for _, attempt := range failed {
+				s.observeAttempt(d, recipients[i], attempt)
 			}
-			m.Headers["Bcc"] = []byte(recipient.String())
-			rawMail := m.encode()
-			_, err = signer.Write(rawMail)
-			if err != nil {
-				report[recipient.Address] = err
-				continue
+			if len(failed) > 0 {
+				errs[i] = failed[len(failed)-1].Err
 			}
-			err = signer.Close()
-			if err != nil {
-				report[recipient.Address] = err
-				continue
+		}
+		if conn == nil {
+			break
+		}
+		ips = rest
+		connection := &Attempt{MX: mx, IP: ip}
+		if source != nil {
+			connection.LocalIP = source.IP
+		}
+		batch := make([]string, len(pending))
+		for j, i := range pending {
+			batch[j] = recipients[i]
+		}
+		var transcript bytes.Buffer
+		batchErrs := s.transmit(d, conn, mx, source, sender, batch, data, s.transcript(d, batch, connection, &transcript))
+		if s.Transcripts {
+			connection.Transcript = transcript.String()
+		}
+		var next []int
+		for j, i := range pending {
+			attempt := *connection
+			attempt.Err, attempt.Rejected = unwrapRcptError(batchErrs[j])
+			attempts[i] = append(attempts[i], &attempt)
+			s.observeAttempt(d, recipients[i], &attempt)
+			errs[i] = attempt.Err
+			if attempt.Err != nil && statusOf(attempt.Err) != Failed {
+				next = append(next, i)
 			}
-			var buffer bytes.Buffer
-			buffer.WriteString(signer.Signature())
-			buffer.Write(rawMail)
+		}
+		pending = next
+	}
+	return attempts, errs
+}
+
+func (s *Service) port() string {
+	if s.Port == "" {
+		return "smtp"
+	}
+	return s.Port
+}
 
-			addr, err := resolveAddr(recipient.Address)
+// transmit runs the SMTP transaction over the connection to the MX host
+// It returns the error of each recipient, the conversation is written to the transcript if it is not nil
+func (s *Service) transmit(d *delivery, conn net.Conn, host string, source *SourceAddr, sender string, recipients []string, data []byte, transcript io.Writer) []error {
+	c, err := newClient(conn, host, false)
+	if err != nil {
+		return sameErrors(len(recipients), err)
+	}
+	return s.transmitVia(c, d, s.hostname(source), nil, false, sender, recipients, data, transcript)
+}
+
+// transmitVia runs the SMTP transaction over the client and closes it, every transport connecting to a server shares it
+// The client introduces itself with localName unless it is empty and authenticates with auth if it is not nil
+// The credentials are sent over TLS only unless insecureAuth is set
+// It returns the error of each recipient, the conversation is written to the transcript if it is not nil
+// STARTTLS is used whenever the server supports it
+// The mail is converted to 7-bit if it has 8-bit content and the server doesn't support 8BITMIME
+func (s *Service) transmitVia(c *smtp.Client, d *delivery, localName string, auth sasl.Client, insecureAuth bool, sender string, recipients []string, data []byte, transcript io.Writer) []error {
+	defer c.Close()
+	c.Transcript = transcript
+	if localName != "" {
+		err := c.Hello(localName)
+		if err != nil {
+			return sameErrors(len(recipients), err)
+		}
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if _, isTLS := c.TLSConnectionState(); !isTLS {
+			start := time.Now()
+			err := c.StartTLS(nil)
 			if err != nil {
-				report[recipient.Address] = err
-				continue
+				return sameErrors(len(recipients), err)
 			}
-			ctx, _ := context.WithTimeout(context.Background(), timeout)
-			mxs, err := net.DefaultResolver.LookupMX(ctx, addr)
-			if err != nil || len(mxs) == 0 {
-				mxs = []*net.MX{{Host: addr}}
+			if s.Metrics != nil {
+				s.Metrics.TLSHandshakeLatency(time.Since(start))
 			}
-			var firstError error
-			for _, mx := range mxs {
-				err = smtp.SendMail(mx.Host+":smtp", nil, from.Address, []string{recipient.Address}, &buffer, s.domain)
-				if err == nil {
-					firstError = nil
-					break
-				}
-				if firstError == nil {
-					firstError = err
-				}
-			}
-			if firstError != nil {
-				report[recipient.Address] = firstError
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return sameErrors(len(recipients), errors.New("smtp: server doesn't support AUTH"))
+		}
+		if _, isTLS := c.TLSConnectionState(); !isTLS && !insecureAuth {
+			return sameErrors(len(recipients), errors.New("smtp: refusing AUTH over an unencrypted connection"))
+		}
+		err := c.Auth(auth)
+		if err != nil {
+			return sameErrors(len(recipients), err)
+		}
+	}
+	if ok, _ := c.Extension("8BITMIME"); !ok && has8bit(data) {
+		if d.downgraded == nil {
+			var err error
+			d.downgraded, err = s.downgrade(data, d.signed)
+			if err != nil {
+				return sameErrors(len(recipients), errors.Wrap(err, "converting mail to 7-bit failed"))
 			}
 		}
+		data = d.downgraded
 	}
-	return report, nil
+	errs := transaction(c, sender, recipients, bytes.NewReader(data))
+	// The outcomes are known already, a failing QUIT doesn't change them
+	c.Quit()
+	return errs
 }
 
+// resolveAddr returns the domain of the address, the local part may contain @ if it is quoted
 func resolveAddr(addr string) (string, error) {
-	parts := strings.SplitN(addr, "@", 2)
-	if len(parts) != 2 {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
 		return "", errors.New("invalid mail address")
 	}
-	return parts[1], nil
+	return addr[at+1:], nil
 }
@@ -0,0 +1,65 @@
+package ms
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestService_Deliver_bcc(t *testing.T) {
+	transport := &MemoryTransport{}
+	s := newTestService(t)
+	s.Transport = transport
+	m := &Mail{
+		Headers: map[string][]byte{
+			"From":    []byte("joe@example.org"),
+			"To":      []byte("jane@example.com"),
+			"Bcc":     []byte("Bob <bob@example.com>, ann@example.net, jane@example.com"),
+			"Subject": []byte("Hello"),
+		},
+		Body: []byte("Hello"),
+	}
+	report, err := s.Deliver(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Recipients) != 3 || len(report.Errors()) != 0 {
+		t.Fatal("Invalid report:", report.Recipients)
+	}
+	if len(m.Headers) != 4 || string(m.Headers["Bcc"]) != "Bob <bob@example.com>, ann@example.net, jane@example.com" {
+		t.Error("Mail is modified:", m.Headers)
+	}
+	mails := transport.Mails()
+	if len(mails) != 1 {
+		t.Fatal("Invalid number of mails:", len(mails))
+	}
+	if strings.Join(mails[0].Envelope.Recipients, ",") != "jane@example.com,bob@example.com,ann@example.net" {
+		t.Error("Invalid recipients:", mails[0].Envelope.Recipients)
+	}
+	if bytes.Contains(mails[0].Data, []byte("Bcc:")) {
+		t.Error("Bcc header is leaked")
+	}
+	if bytes.Count(mails[0].Data, []byte("DKIM-Signature:")) != 1 {
+		t.Error("Mail is not signed once")
+	}
+
+	transport.Reset()
+	s.BccHeader = true
+	_, err = s.Deliver(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mails = transport.Mails()
+	if len(mails) != 3 {
+		t.Fatal("Invalid number of mails:", len(mails))
+	}
+	if bytes.Contains(mails[0].Data, []byte("Bcc:")) {
+		t.Error("Bcc header is sent to the visible recipients")
+	}
+	if mails[1].Envelope.Recipients[0] != "bob@example.com" || !bytes.Contains(mails[1].Data, []byte("Bcc: \"Bob\" <bob@example.com>\r\n")) {
+		t.Errorf("Invalid copy of the Bcc recipient: %v %q", mails[1].Envelope.Recipients, mails[1].Data)
+	}
+	if bytes.Contains(mails[1].Data, []byte("ann@example.net")) {
+		t.Error("Other Bcc recipients are leaked")
+	}
+}
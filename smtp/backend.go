@@ -29,6 +29,10 @@ type MailOptions struct {
 	// Size of the body. Can be 0 if not specified by client.
 	Size int
 
+	// Body is the type of the body (RFC 1652, RFC 3030). Empty if not
+	// specified by client.
+	Body BodyType
+
 	// TLS is required for the message transmission.
 	//
 	// The message should be rejected if it can't be transmitted
@@ -38,6 +42,59 @@ type MailOptions struct {
 	// The message envelope or message header contains UTF-8-encoded strings.
 	// This flag is set by SMTPUTF8-aware (RFC 6531) client.
 	UTF8 bool
+
+	// Return specifies whether the full message or only the headers should
+	// be returned in delivery status notifications (RFC 3461). Empty if not
+	// specified by client.
+	Return DSNReturn
+
+	// EnvelopeID is the envelope identifier (RFC 3461) to be included in
+	// delivery status notifications. Empty if not specified by client.
+	EnvelopeID string
+}
+
+// BodyType is the value of the BODY parameter of the MAIL command.
+type BodyType string
+
+const (
+	Body7Bit       BodyType = "7BIT"
+	Body8BitMIME   BodyType = "8BITMIME"
+	BodyBinaryMIME BodyType = "BINARYMIME"
+)
+
+// DSNReturn is the value of the RET parameter of the MAIL command.
+type DSNReturn string
+
+const (
+	DSNReturnFull    DSNReturn = "FULL"
+	DSNReturnHeaders DSNReturn = "HDRS"
+)
+
+// DSNNotify is a value of the NOTIFY parameter of the RCPT command.
+type DSNNotify string
+
+const (
+	DSNNotifyNever   DSNNotify = "NEVER"
+	DSNNotifySuccess DSNNotify = "SUCCESS"
+	DSNNotifyFailure DSNNotify = "FAILURE"
+	DSNNotifyDelayed DSNNotify = "DELAY"
+)
+
+// RcptOptions contains custom arguments that were
+// passed as an argument to the RCPT command.
+type RcptOptions struct {
+	// Notify lists the conditions under which a delivery status
+	// notification (RFC 3461) should be generated. Empty if not specified
+	// by client.
+	Notify []DSNNotify
+
+	// OriginalRecipientType is the address type of OriginalRecipient,
+	// usually "rfc822".
+	OriginalRecipientType string
+
+	// OriginalRecipient is the original recipient (RFC 3461) to be included
+	// in delivery status notifications. Empty if not specified by client.
+	OriginalRecipient string
 }
 
 // Session represent a SMTP session
@@ -53,9 +110,21 @@ type Session interface {
 	// Add recipient for currently processed message.
 	Rcpt(to string) error
 	// Set currently processed message contents and send it.
+	//
+	// The line endings of the message are converted to LF, whether it is
+	// received with DATA, which is dot-unstuffed too, or in BDAT chunks
+	// (RFC 3030). A message sent with BODY=BINARYMIME is passed as it is sent.
 	Data(r io.Reader) error
 }
 
+// RcptSession can be optionally implemented by the backend to receive the
+// arguments passed to the RCPT command, such as DSN (RFC 3461) parameters.
+// If implemented, RcptWithOptions is called instead of Session.Rcpt.
+type RcptSession interface {
+	// Add recipient for currently processed message.
+	RcptWithOptions(to string, opts RcptOptions) error
+}
+
 type LMTPSession interface {
 	// LMTPData is the LMTP-specific version of Data method.
 	// It can be optionally implemented by the backend to provide
@@ -41,6 +41,19 @@ type Client struct {
 	didHello    bool   // whether we've said HELO/EHLO/LHLO
 	helloError  error  // the error from the hello
 	rcptToCount int    // number of recipients
+	binaryMIME  bool   // whether the message is sent with BODY=BINARYMIME
+
+	// Transcript receives the conversation with the server if it is not nil.
+	// Lines sent by the client are prefixed with "C: " and the ones sent by
+	// the server are prefixed with "S: ". The credentials sent during AUTH are
+	// redacted and the message data is replaced by its size. The greeting of
+	// the server is written once Transcript is set.
+	Transcript     io.Writer
+	greeting       []byte // the transcript of the greeting until Transcript is set
+	greeted        bool   // whether the greeting is read
+	authenticating bool   // whether the client is sending credentials
+	sendingData    bool   // whether the client is sending the message data
+	dataSize       int    // the size of the message data sent so far
 }
 
 // Dial returns a new Client connected to an SMTP server at addr.
@@ -72,31 +85,18 @@ func DialTLS(addr string, tlsConfig *tls.Config) (*Client, error) {
 // NewClient returns a new Client using an existing connection and host as a
 // server name to be used when authenticating.
 func NewClient(conn net.Conn, host string) (*Client, error) {
-	rwc := struct {
-		io.Reader
-		io.Writer
-		io.Closer
-	}{
-		Reader: lineLimitReader{
-			R: conn,
-			// Doubled maximum line length per RFC 5321 (Section 4.5.3.1.6)
-			LineLimit: 2000,
-		},
-		Writer: conn,
-		Closer: conn,
-	}
-
-	text := textproto.NewConn(rwc)
-	_, _, err := text.ReadResponse(220)
+	_, isTLS := conn.(*tls.Conn)
+	c := &Client{conn: conn, serverName: host, localName: "localhost", tls: isTLS}
+	c.Text = textproto.NewConn(c.textConn(conn))
+	_, _, err := c.Text.ReadResponse(220)
 	if err != nil {
-		text.Close()
+		c.Text.Close()
 		if protoErr, ok := err.(*textproto.Error); ok {
 			return nil, toSMTPErr(protoErr)
 		}
 		return nil, err
 	}
-	_, isTLS := conn.(*tls.Conn)
-	c := &Client{Text: text, conn: conn, serverName: host, localName: "localhost", tls: isTLS}
+	c.greeted = true
 	return c, nil
 }
 
@@ -229,7 +229,7 @@ func (c *Client) StartTLS(config *tls.Config) error {
 		testHookStartTLS(config)
 	}
 	c.conn = tls.Client(c.conn, config)
-	c.Text = textproto.NewConn(c.conn)
+	c.Text = textproto.NewConn(c.textConn(c.conn))
 	c.tls = true
 	return c.ehlo()
 }
@@ -270,6 +270,10 @@ func (c *Client) Auth(a sasl.Client) error {
 	if err := c.hello(); err != nil {
 		return err
 	}
+	c.authenticating = true
+	defer func() {
+		c.authenticating = false
+	}()
 	encoding := base64.StdEncoding
 	mech, resp, err := a.Start()
 	if err != nil {
@@ -313,12 +317,16 @@ func (c *Client) Auth(a sasl.Client) error {
 
 // Mail issues a MAIL command to the server using the provided email address.
 // If the server supports the 8BITMIME extension, Mail adds the BODY=8BITMIME
-// parameter.
+// parameter unless opts.Body is set. BODY=BINARYMIME requires the server to
+// support the BINARYMIME and CHUNKING extensions (RFC 3030).
 // This initiates a mail transaction and is followed by one or more Rcpt calls.
 //
 // If opts is not nil, MAIL arguments provided in the structure will be added
 // to the command. Handling of unsupported options depends on the extension.
 //
+// If opts.Size exceeds the maximum message size advertised by the server
+// (RFC 1870), Mail fails with a 552 5.3.4 error without sending the command.
+//
 // If server returns an error, it will be of type *SMTPError.
 func (c *Client) Mail(from string, opts *MailOptions) error {
 	if err := validateLine(from); err != nil {
@@ -327,30 +335,83 @@ func (c *Client) Mail(from string, opts *MailOptions) error {
 	if err := c.hello(); err != nil {
 		return err
 	}
+	cmdStr, err := c.mailCmd(opts)
+	if err != nil {
+		return err
+	}
+	if _, _, err := c.cmd(250, cmdStr, from); err != nil {
+		return err
+	}
+	c.binaryMIME = opts != nil && opts.Body == BodyBinaryMIME
+	return nil
+}
+
+// mailCmd returns the format string of the MAIL command with the arguments
+// of opts, to be formatted with the sender address.
+func (c *Client) mailCmd(opts *MailOptions) (string, error) {
 	cmdStr := "MAIL FROM:<%s>"
-	if _, ok := c.ext["8BITMIME"]; ok {
-		cmdStr += " BODY=8BITMIME"
+	var body BodyType
+	if opts != nil {
+		body = opts.Body
+	}
+	switch body {
+	case "":
+		if _, ok := c.ext["8BITMIME"]; ok {
+			cmdStr += " BODY=8BITMIME"
+		}
+	case Body7Bit, Body8BitMIME:
+		if _, ok := c.ext["8BITMIME"]; ok {
+			cmdStr += " BODY=" + string(body)
+		} else if body == Body8BitMIME {
+			return "", errors.New("smtp: server does not support 8BITMIME")
+		}
+	case BodyBinaryMIME:
+		_, binaryMIME := c.ext["BINARYMIME"]
+		_, chunking := c.ext["CHUNKING"]
+		if !binaryMIME || !chunking {
+			return "", errors.New("smtp: server does not support BINARYMIME")
+		}
+		cmdStr += " BODY=BINARYMIME"
+	default:
+		return "", errors.New("smtp: Unknown BODY parameter value")
 	}
 	if _, ok := c.ext["SIZE"]; ok && opts != nil && opts.Size != 0 {
+		if max := c.maxMessageSize(); max > 0 && opts.Size > max {
+			return "", &SMTPError{
+				Code:         552,
+				EnhancedCode: EnhancedCode{5, 3, 4},
+				Message:      fmt.Sprintf("Message size of %v bytes exceeds the limit of the server of %v bytes", opts.Size, max),
+			}
+		}
 		cmdStr += " SIZE=" + strconv.Itoa(opts.Size)
 	}
 	if opts != nil && opts.RequireTLS {
 		if _, ok := c.ext["REQUIRETLS"]; ok {
 			cmdStr += " REQUIRETLS"
 		} else {
-			return errors.New("smtp: server does not support REQUIRETLS")
+			return "", errors.New("smtp: server does not support REQUIRETLS")
 		}
 	}
 	if opts != nil && opts.UTF8 {
 		if _, ok := c.ext["SMTPUTF8"]; ok {
 			cmdStr += " SMTPUTF8"
 		} else {
-			return errors.New("smtp: server does not support SMTPUTF8")
+			return "", errors.New("smtp: server does not support SMTPUTF8")
 		}
 	}
-
-	_, _, err := c.cmd(250, cmdStr, from)
-	return err
+	if _, ok := c.ext["DSN"]; ok && opts != nil {
+		switch opts.Return {
+		case DSNReturnFull, DSNReturnHeaders:
+			cmdStr += " RET=" + string(opts.Return)
+		case "":
+		default:
+			return "", errors.New("smtp: Unknown RET parameter value")
+		}
+		if opts.EnvelopeID != "" {
+			cmdStr += " ENVID=" + escapeFormat(encodeXtext(opts.EnvelopeID))
+		}
+	}
+	return cmdStr, nil
 }
 
 // Rcpt issues a RCPT command to the server using the provided email address.
@@ -359,44 +420,206 @@ func (c *Client) Mail(from string, opts *MailOptions) error {
 //
 // If server returns an error, it will be of type *SMTPError.
 func (c *Client) Rcpt(to string) error {
+	return c.RcptWithOptions(to, nil)
+}
+
+// RcptWithOptions issues a RCPT command to the server like Rcpt does.
+//
+// If opts is not nil, RCPT arguments provided in the structure will be added
+// to the command. DSN (RFC 3461) parameters are only sent if the server
+// advertises the DSN extension.
+//
+// If server returns an error, it will be of type *SMTPError.
+func (c *Client) RcptWithOptions(to string, opts *RcptOptions) error {
 	if err := validateLine(to); err != nil {
 		return err
 	}
-	if _, _, err := c.cmd(25, "RCPT TO:<%s>", to); err != nil {
+	cmdStr, err := c.rcptCmd(opts)
+	if err != nil {
+		return err
+	}
+	if _, _, err := c.cmd(25, cmdStr, to); err != nil {
 		return err
 	}
 	c.rcptToCount++
 	return nil
 }
 
+// rcptCmd returns the format string of the RCPT command with the arguments
+// of opts, to be formatted with the recipient address.
+func (c *Client) rcptCmd(opts *RcptOptions) (string, error) {
+	cmdStr := "RCPT TO:<%s>"
+	if _, ok := c.ext["DSN"]; ok && opts != nil {
+		if len(opts.Notify) != 0 {
+			notify := make([]string, len(opts.Notify))
+			for i, n := range opts.Notify {
+				switch n {
+				case DSNNotifyNever, DSNNotifySuccess, DSNNotifyFailure, DSNNotifyDelayed:
+				default:
+					return "", errors.New("smtp: Unknown NOTIFY parameter value")
+				}
+				if n == DSNNotifyNever && len(opts.Notify) != 1 {
+					return "", errors.New("smtp: NOTIFY=NEVER cannot be combined with other options")
+				}
+				notify[i] = string(n)
+			}
+			cmdStr += " NOTIFY=" + strings.Join(notify, ",")
+		}
+		if opts.OriginalRecipient != "" {
+			if err := validateLine(opts.OriginalRecipient); err != nil {
+				return "", err
+			}
+			addrType := opts.OriginalRecipientType
+			if err := validateLine(addrType); err != nil {
+				return "", err
+			}
+			if addrType == "" {
+				addrType = "rfc822"
+			}
+			cmdStr += " ORCPT=" + escapeFormat(addrType+";"+encodeXtext(opts.OriginalRecipient))
+		}
+	}
+	return cmdStr, nil
+}
+
 type dataCloser struct {
 	c *Client
 	io.WriteCloser
+	statuses []error
 }
 
 func (d *dataCloser) Close() error {
 	d.WriteCloser.Close()
-	if d.c.lmtp {
-		for d.c.rcptToCount > 0 {
-			if _, _, err := d.c.Text.ReadResponse(250); err != nil {
-				if protoErr, ok := err.(*textproto.Error); ok {
-					return toSMTPErr(protoErr)
-				}
-				return err
+	d.c.endData()
+	var err error
+	d.statuses, err = d.c.readDataResponse()
+	return err
+}
+
+func (d *dataCloser) status() []error {
+	return d.statuses
+}
+
+// statusWriter is a writer of a message that reports the status of each
+// recipient replied by a LMTP server once it is closed.
+type statusWriter interface {
+	io.WriteCloser
+	status() []error
+}
+
+// readDataResponse reads the response to the end of the message, which is
+// a response per recipient for LMTP. The responses of all the recipients are
+// read and returned in the order of the RCPT commands, the first failure is
+// returned as err.
+func (c *Client) readDataResponse() (statuses []error, err error) {
+	if c.lmtp {
+		for c.rcptToCount > 0 {
+			status := c.readResponse(250)
+			if !isReply(status) {
+				return statuses, status
+			}
+			statuses = append(statuses, status)
+			if err == nil {
+				err = status
 			}
-			d.c.rcptToCount--
+			c.rcptToCount--
 		}
-		return nil
+		return statuses, err
 	} else {
-		_, _, err := d.c.Text.ReadResponse(250)
-		if err != nil {
-			if protoErr, ok := err.(*textproto.Error); ok {
-				return toSMTPErr(protoErr)
+		return nil, c.readResponse(250)
+	}
+}
+
+// bdatChunkSize is the size of the chunks sent with BDAT commands.
+const bdatChunkSize = 64 * 1024
+
+// bdatWriter sends the message in chunks with BDAT commands (RFC 3030).
+// Bare LF line endings are converted to CRLF like DotWriter does, unless the
+// message is binary.
+type bdatWriter struct {
+	c        *Client
+	buf      []byte
+	binary   bool
+	cr       bool // whether the last byte written is CR
+	err      error
+	statuses []error
+}
+
+func (w *bdatWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	for i, b := range p {
+		if b == '\n' && !w.cr && !w.binary {
+			w.buf = append(w.buf, '\r')
+		}
+		w.buf = append(w.buf, b)
+		w.cr = b == '\r'
+		if len(w.buf) >= bdatChunkSize {
+			if w.err = w.send(false); w.err != nil {
+				return i + 1, w.err
 			}
-			return err
 		}
-		return nil
 	}
+	return len(p), nil
+}
+
+func (w *bdatWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.send(true)
+	if w.err != nil {
+		return w.err
+	}
+	w.err = errors.New("smtp: BDAT writer is closed")
+	return nil
+}
+
+// send sends the buffered data as a chunk and reads the response.
+func (w *bdatWriter) send(last bool) error {
+	cmd := fmt.Sprintf("BDAT %d", len(w.buf))
+	if last {
+		cmd += " LAST"
+	}
+	id := w.c.Text.Next()
+	w.c.Text.StartRequest(id)
+	err := w.c.Text.PrintfLine("%s", cmd)
+	if err == nil {
+		w.c.startData()
+		_, err = w.c.Text.W.Write(w.buf)
+		if err == nil {
+			err = w.c.Text.W.Flush()
+		}
+		w.c.endData()
+	}
+	w.c.Text.EndRequest(id)
+	if err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+
+	w.c.Text.StartResponse(id)
+	defer w.c.Text.EndResponse(id)
+	if last {
+		w.statuses, err = w.c.readDataResponse()
+		return err
+	}
+	return w.c.readResponse(250)
+}
+
+func (w *bdatWriter) status() []error {
+	return w.statuses
+}
+
+// readResponse reads a response to a command sent before, converting
+// textproto.Error into SMTPError.
+func (c *Client) readResponse(expectCode int) error {
+	_, _, err := c.Text.ReadResponse(expectCode)
+	if protoErr, ok := err.(*textproto.Error); ok {
+		return toSMTPErr(protoErr)
+	}
+	return err
 }
 
 // Data issues a DATA command to the server and returns a writer that
@@ -404,13 +627,239 @@ func (d *dataCloser) Close() error {
 // close the writer before calling any more methods on c. A call to
 // Data must be preceded by one or more calls to Rcpt.
 //
+// If the server advertises the CHUNKING extension (RFC 3030), the message is
+// sent in chunks with BDAT commands instead, as it is written. The errors of
+// the server are then returned by the writer. A message declared with
+// BODY=BINARYMIME is always sent with BDAT and its bytes are sent as they are.
+//
 // If server returns an error, it will be of type *SMTPError.
 func (c *Client) Data() (io.WriteCloser, error) {
+	if _, ok := c.ext["CHUNKING"]; ok {
+		return &bdatWriter{c: c, binary: c.binaryMIME}, nil
+	}
 	_, _, err := c.cmd(354, "DATA")
 	if err != nil {
 		return nil, err
 	}
-	return &dataCloser{c, c.Text.DotWriter()}, nil
+	c.startData()
+	return &dataCloser{c: c, WriteCloser: c.Text.DotWriter()}, nil
+}
+
+// errNoRecipients is returned by MailPipelined if none of the recipients is
+// accepted.
+var errNoRecipients = errors.New("smtp: none of the recipients is accepted")
+
+// MailPipelined issues MAIL, a RCPT for each recipient and DATA like Mail,
+// Rcpt and Data do. If the server supports the PIPELINING extension
+// (RFC 2920), the commands are sent in a single batch and their replies are
+// read afterwards, instead of waiting for the reply of each command. Otherwise
+// the commands are sent one by one.
+//
+// A rejected recipient doesn't stop the transaction. The error of each
+// recipient is returned in the order of to, nil for the accepted ones, and
+// the message is sent to the accepted ones with the returned writer. The
+// caller should close the writer as the one returned by Data.
+//
+// If MAIL or DATA is rejected or none of the recipients is accepted, no writer
+// is returned and err is set, the transaction should be aborted with Reset
+// then. If server returns an error, it will be of type *SMTPError.
+func (c *Client) MailPipelined(from string, opts *MailOptions, to []string) (rcptErrs []error, w io.WriteCloser, err error) {
+	if err := validateLine(from); err != nil {
+		return nil, nil, err
+	}
+	for _, rcpt := range to {
+		if err := validateLine(rcpt); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := c.hello(); err != nil {
+		return nil, nil, err
+	}
+	if _, ok := c.ext["PIPELINING"]; !ok {
+		return c.mailLockstep(from, opts, to)
+	}
+	mailCmd, err := c.mailCmd(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	rcptCmd, err := c.rcptCmd(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	// BDAT commands are sent with the message, DATA is sent with the batch
+	_, chunking := c.ext["CHUNKING"]
+
+	id := c.Text.Next()
+	c.Text.StartRequest(id)
+	fmt.Fprintf(c.Text.W, mailCmd+"\r\n", from)
+	for _, rcpt := range to {
+		fmt.Fprintf(c.Text.W, rcptCmd+"\r\n", rcpt)
+	}
+	if !chunking {
+		c.Text.W.WriteString("DATA\r\n")
+	}
+	err = c.Text.W.Flush()
+	c.Text.EndRequest(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	mailErr := c.readResponse(250)
+	if !isReply(mailErr) {
+		return nil, nil, mailErr
+	}
+	rcptErrs = make([]error, len(to))
+	accepted := 0
+	for i := range to {
+		rcptErrs[i] = c.readResponse(25)
+		if !isReply(rcptErrs[i]) {
+			return nil, nil, rcptErrs[i]
+		}
+		if rcptErrs[i] == nil {
+			accepted++
+		}
+	}
+	if mailErr == nil {
+		c.rcptToCount += accepted
+		c.binaryMIME = opts != nil && opts.Body == BodyBinaryMIME
+	} else {
+		accepted = 0
+	}
+	if chunking {
+		switch {
+		case mailErr != nil:
+			return nil, nil, mailErr
+		case accepted == 0:
+			return rcptErrs, nil, errNoRecipients
+		}
+		return rcptErrs, &bdatWriter{c: c, binary: c.binaryMIME}, nil
+	}
+
+	dataErr := c.readResponse(354)
+	if !isReply(dataErr) {
+		return nil, nil, dataErr
+	}
+	if dataErr == nil && accepted == 0 {
+		// The server waits for the message although the transaction failed,
+		// so an empty message is sent to end the DATA command.
+		c.Text.W.WriteString(".\r\n")
+		err = c.Text.W.Flush()
+		if err == nil {
+			err = c.readResponse(250)
+		}
+		if !isReply(err) {
+			return nil, nil, err
+		}
+	}
+	switch {
+	case mailErr != nil:
+		return nil, nil, mailErr
+	case accepted == 0:
+		return rcptErrs, nil, errNoRecipients
+	case dataErr != nil:
+		return rcptErrs, nil, dataErr
+	}
+	c.startData()
+	return rcptErrs, &dataCloser{c: c, WriteCloser: c.Text.DotWriter()}, nil
+}
+
+// isReply reports whether err is nil or an error replied by the server, rather
+// than an error that stops the replies from being read.
+func isReply(err error) bool {
+	_, ok := err.(*SMTPError)
+	return err == nil || ok
+}
+
+// mailLockstep issues the commands of MailPipelined one by one.
+func (c *Client) mailLockstep(from string, opts *MailOptions, to []string) ([]error, io.WriteCloser, error) {
+	if err := c.Mail(from, opts); err != nil {
+		return nil, nil, err
+	}
+	rcptErrs := make([]error, len(to))
+	accepted := false
+	for i, rcpt := range to {
+		rcptErrs[i] = c.Rcpt(rcpt)
+		if rcptErrs[i] == nil {
+			accepted = true
+		}
+	}
+	if !accepted {
+		return rcptErrs, nil, errNoRecipients
+	}
+	w, err := c.Data()
+	if err != nil {
+		return rcptErrs, nil, err
+	}
+	return rcptErrs, w, nil
+}
+
+// Transaction runs a mail transaction sending the message r from address
+// from to addresses to, with the commands pipelined as MailPipelined does.
+// Unlike SendMail, a rejected recipient doesn't abort the transaction, the
+// message is still delivered to the accepted ones.
+//
+// The errors replied to the recipients themselves are returned in rcptErrs in
+// the order of to: the replies to their RCPT commands and over LMTP the
+// statuses replied for them after the message. err is the failure of the
+// whole transaction, such as a rejected MAIL command or a reply after the
+// message, it applies to the recipients without an error in rcptErrs. The
+// message is delivered to the recipients without an error in either. The size
+// of r is declared as SendMail does unless opts has it.
+//
+// A transaction failing after MAIL is accepted is reset, so that the client
+// can be used for another one.
+func (c *Client) Transaction(from string, opts *MailOptions, to []string, r io.Reader) (rcptErrs []error, err error) {
+	if opts == nil || opts.Size == 0 {
+		if size := messageSize(r); size > 0 {
+			sized := MailOptions{}
+			if opts != nil {
+				sized = *opts
+			}
+			sized.Size = size
+			opts = &sized
+		}
+	}
+	rcptErrs, w, err := c.MailPipelined(from, opts, to)
+	if rcptErrs == nil {
+		// MAIL failed or the replies couldn't be read
+		return make([]error, len(to)), err
+	}
+	if err != nil {
+		c.Reset()
+		return rcptErrs, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return rcptErrs, err
+	}
+	err = w.Close()
+	var statuses []error
+	if w, ok := w.(statusWriter); ok {
+		statuses = w.status()
+	}
+	if statuses == nil {
+		return rcptErrs, err
+	}
+	j := 0
+	for i := range rcptErrs {
+		if rcptErrs[i] != nil {
+			continue
+		}
+		if j == len(statuses) {
+			// The statuses of the rest couldn't be read after the failure
+			return rcptErrs, err
+		}
+		rcptErrs[i] = statuses[j]
+		j++
+	}
+	return rcptErrs, nil
+}
+
+// escapeFormat escapes the verbs in s so that it can be appended to a format
+// string passed to cmd.
+func escapeFormat(s string) string {
+	return strings.Replace(s, "%", "%%", -1)
 }
 
 var testHookStartTLS func(*tls.Config) // nil, except for tests
@@ -450,10 +899,40 @@ func SendMail(addr string, a sasl.Client, from string, to []string, r io.Reader,
 	}
 	defer c.Close()
 	c.localName = localName
+	if err = c.SendMail(a, from, to, r); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// SendMail switches to TLS if possible, authenticates with the optional
+// mechanism a if possible, and then sends an email from address from, to
+// addresses to, with message r over an existing connection.
+//
+// See the SendMail function for the details of the parameters. Unlike the
+// SendMail function, the connection is left open so that the caller can
+// send more mails or Quit.
+//
+// SendMail fails on the first rejected recipient, Transaction should be used
+// to deliver the message to the accepted ones and get the result of each.
+//
+// If the size of r can be known without reading it, such as for
+// *bytes.Reader, it is declared with the SIZE parameter, so a message over
+// the limit of the server fails before it is transmitted.
+func (c *Client) SendMail(a sasl.Client, from string, to []string, r io.Reader) error {
+	if err := validateLine(from); err != nil {
+		return err
+	}
+	for _, recp := range to {
+		if err := validateLine(recp); err != nil {
+			return err
+		}
+	}
+	var err error
 	if err = c.hello(); err != nil {
 		return err
 	}
-	if ok, _ := c.Extension("STARTTLS"); ok {
+	if ok, _ := c.Extension("STARTTLS"); ok && !c.tls {
 		if err = c.StartTLS(nil); err != nil {
 			return err
 		}
@@ -466,7 +945,11 @@ func SendMail(addr string, a sasl.Client, from string, to []string, r io.Reader,
 			return err
 		}
 	}
-	if err = c.Mail(from, nil); err != nil {
+	var opts *MailOptions
+	if size := messageSize(r); size > 0 {
+		opts = &MailOptions{Size: size}
+	}
+	if err = c.Mail(from, opts); err != nil {
 		return err
 	}
 	for _, addr := range to {
@@ -482,11 +965,40 @@ func SendMail(addr string, a sasl.Client, from string, to []string, r io.Reader,
 	if err != nil {
 		return err
 	}
-	err = w.Close()
-	if err != nil {
-		return err
+	return w.Close()
+}
+
+// messageSize returns the number of bytes left in r if it can be known without
+// reading them, such as for *bytes.Reader and *strings.Reader, or 0.
+func messageSize(r io.Reader) int {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return r.Len()
+	case io.Seeker:
+		current, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0
+		}
+		end, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0
+		}
+		if _, err := r.Seek(current, io.SeekStart); err != nil {
+			return 0
+		}
+		return int(end - current)
 	}
-	return c.Quit()
+	return 0
+}
+
+// maxMessageSize returns the maximum message size advertised by the server
+// with the SIZE extension, or 0 if there is no limit.
+func (c *Client) maxMessageSize() int {
+	max, err := strconv.Atoi(c.ext["SIZE"])
+	if err != nil || max < 0 {
+		return 0
+	}
+	return max
 }
 
 // Extension reports whether an extension is support by the server.
@@ -15,6 +15,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/emersion/go-sasl"
@@ -557,7 +558,7 @@ func TestSendMail(t *testing.T) {
 To: other@example.com
 Subject: SendMail test
 SendMail is working for me.
-`, "\n", "\r\n", -1)))
+`, "\n", "\r\n", -1)), "localhost")
 	if err == nil {
 		t.Errorf("Expected SendMail to be rejected due to a message injection attempt")
 	}
@@ -567,7 +568,7 @@ To: other@example.com
 Subject: SendMail test
 
 SendMail is working for me.
-`, "\n", "\r\n", -1)))
+`, "\n", "\r\n", -1)), "localhost")
 
 	if err != nil {
 		t.Errorf("%v", err)
@@ -637,7 +638,7 @@ func TestSendMailWithAuth(t *testing.T) {
 To: other@example.com
 Subject: SendMail test
 SendMail is working for me.
-`, "\n", "\r\n", -1)))
+`, "\n", "\r\n", -1)), "localhost")
 	if err == nil {
 		t.Error("SendMail: Server doesn't support AUTH, expected to get an error, but got none ")
 	}
@@ -841,7 +842,7 @@ func init() {
 func sendMail(hostPort string) error {
 	from := "joe1@example.com"
 	to := []string{"joe2@example.com"}
-	return SendMail(hostPort, nil, from, to, strings.NewReader("Subject: test\n\nhowdy!"))
+	return SendMail(hostPort, nil, from, to, strings.NewReader("Subject: test\n\nhowdy!"), "localhost")
 }
 
 // localhostCert is a PEM-encoded TLS cert generated from src/crypto/tls:
@@ -931,6 +932,49 @@ Goodbye.`
 	}
 }
 
+func TestClientDSN(t *testing.T) {
+	server := strings.Join(strings.Split(dsnServer, "\n"), "\r\n")
+	client := strings.Join(strings.Split(dsnClient, "\n"), "\r\n")
+
+	var cmdbuf bytes.Buffer
+	bcmdbuf := bufio.NewWriter(&cmdbuf)
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+	c := &Client{Text: textproto.NewConn(fake), localName: "localhost"}
+
+	if err := c.Mail("user@gmail.com", &MailOptions{Return: DSNReturnHeaders, EnvelopeID: "QQ+314"}); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	if err := c.RcptWithOptions("golang-nuts@googlegroups.com", &RcptOptions{
+		Notify:            []DSNNotify{DSNNotifySuccess, DSNNotifyFailure},
+		OriginalRecipient: "golang+nuts@googlegroups.com",
+	}); err != nil {
+		t.Fatalf("RCPT failed: %s", err)
+	}
+	if err := c.RcptWithOptions("golang-dev@googlegroups.com", &RcptOptions{
+		Notify: []DSNNotify{DSNNotifyNever, DSNNotifyFailure},
+	}); err == nil {
+		t.Fatalf("RCPT should have failed due to invalid NOTIFY combination")
+	}
+
+	bcmdbuf.Flush()
+	actualcmds := cmdbuf.String()
+	if client != actualcmds {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", actualcmds, client)
+	}
+}
+
+var dsnServer = `250-mx.google.com at your service
+250 DSN
+250 Sender OK
+250 Receiver OK
+`
+
+var dsnClient = `EHLO localhost
+MAIL FROM:<user@gmail.com> RET=HDRS ENVID=QQ+2B314
+RCPT TO:<golang-nuts@googlegroups.com> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;golang+2Bnuts@googlegroups.com
+`
+
 var lmtpServer = `250-localhost at your service
 250-SIZE 35651584
 250 8BITMIME
@@ -955,3 +999,479 @@ Goodbye.
 .
 QUIT
 `
+
+func TestClientSize(t *testing.T) {
+	server := strings.Join(strings.Split(sizeServer, "\n"), "\r\n")
+	client := strings.Join(strings.Split(sizeClient, "\n"), "\r\n")
+
+	var cmdbuf bytes.Buffer
+	bcmdbuf := bufio.NewWriter(&cmdbuf)
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+	c := &Client{Text: textproto.NewConn(fake), localName: "localhost"}
+
+	err := c.Mail("user@gmail.com", &MailOptions{Size: 101})
+	if smtpErr, ok := err.(*SMTPError); !ok || smtpErr.Code != 552 || smtpErr.EnhancedCode != (EnhancedCode{5, 3, 4}) {
+		t.Fatalf("MAIL with too large size should have failed with 552 5.3.4: %v", err)
+	}
+	if err := c.SendMail(nil, "user@gmail.com", []string{"golang-nuts@googlegroups.com"}, strings.NewReader("Hello\r\n")); err != nil {
+		t.Fatalf("SendMail failed: %s", err)
+	}
+
+	bcmdbuf.Flush()
+	actualcmds := cmdbuf.String()
+	if client != actualcmds {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", actualcmds, client)
+	}
+}
+
+var sizeServer = `250-mx.google.com at your service
+250 SIZE 100
+250 Sender OK
+250 Receiver OK
+354 Go ahead
+250 Data OK
+`
+
+var sizeClient = `EHLO localhost
+MAIL FROM:<user@gmail.com> SIZE=7
+RCPT TO:<golang-nuts@googlegroups.com>
+DATA
+Hello
+.
+`
+
+func TestClientChunking(t *testing.T) {
+	server := strings.Join(strings.Split(chunkingServer, "\n"), "\r\n")
+	client := strings.Join(strings.Split(chunkingClient, "\n"), "\r\n")
+
+	var cmdbuf bytes.Buffer
+	bcmdbuf := bufio.NewWriter(&cmdbuf)
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+	c := &Client{Text: textproto.NewConn(fake), localName: "localhost"}
+
+	// The CRLF is split between the chunks and the bare LFs are converted
+	chunk := strings.Repeat("A", bdatChunkSize-1) + "\r"
+	if err := c.SendMail(nil, "user@gmail.com", []string{"golang-nuts@googlegroups.com"}, strings.NewReader(chunk+"\n.\nBye\r\n")); err != nil {
+		t.Fatalf("SendMail failed: %s", err)
+	}
+
+	bcmdbuf.Flush()
+	actualcmds := cmdbuf.String()
+	client += "BDAT 65536\r\n" + chunk + "BDAT 9 LAST\r\n\n.\r\nBye\r\n"
+	if client != actualcmds {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", actualcmds, client)
+	}
+
+	// An error of a chunk fails the message
+	cmdbuf.Reset()
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader("552 5.3.4 Too big\r\n")), bcmdbuf)
+	c = &Client{Text: textproto.NewConn(fake), localName: "localhost", didHello: true, ext: map[string]string{"CHUNKING": ""}}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data failed: %s", err)
+	}
+	if _, err := w.Write([]byte(strings.Repeat("A", bdatChunkSize+1))); err == nil {
+		t.Fatal("Write should have failed")
+	}
+	err = w.Close()
+	if smtpErr, ok := err.(*SMTPError); !ok || smtpErr.Code != 552 {
+		t.Fatal("Close should have failed with 552:", err)
+	}
+}
+
+var chunkingServer = `250-mx.google.com at your service
+250 CHUNKING
+250 Sender OK
+250 Receiver OK
+250 Chunk OK
+250 Message OK
+`
+
+var chunkingClient = `EHLO localhost
+MAIL FROM:<user@gmail.com>
+RCPT TO:<golang-nuts@googlegroups.com>
+`
+
+func TestClientBINARYMIME(t *testing.T) {
+	server := strings.Join(strings.Split(binaryMIMEServer, "\n"), "\r\n")
+	client := strings.Join(strings.Split(binaryMIMEClient, "\n"), "\r\n")
+
+	var cmdbuf bytes.Buffer
+	bcmdbuf := bufio.NewWriter(&cmdbuf)
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+	c := &Client{Text: textproto.NewConn(fake), localName: "localhost"}
+
+	if err := c.Mail("user@gmail.com", &MailOptions{Body: BodyBinaryMIME}); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	if err := c.Rcpt("golang-nuts@googlegroups.com"); err != nil {
+		t.Fatalf("RCPT failed: %s", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data failed: %s", err)
+	}
+	// The line endings of binary data are not converted
+	if _, err := w.Write([]byte("a\nb\x00")); err != nil {
+		t.Fatalf("Data write failed: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Data close failed: %s", err)
+	}
+	if err := c.Mail("user@gmail.com", &MailOptions{Body: Body7Bit}); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+
+	bcmdbuf.Flush()
+	actualcmds := cmdbuf.String()
+	client += "BDAT 4 LAST\r\na\nb\x00MAIL FROM:<user@gmail.com> BODY=7BIT\r\n"
+	if client != actualcmds {
+		t.Fatalf("Got:\n%q\nExpected:\n%q", actualcmds, client)
+	}
+
+	c.ext = map[string]string{"8BITMIME": ""}
+	if err := c.Mail("user@gmail.com", &MailOptions{Body: BodyBinaryMIME}); err == nil {
+		t.Fatal("MAIL should have failed without BINARYMIME")
+	}
+}
+
+var binaryMIMEServer = `250-mx.google.com at your service
+250-8BITMIME
+250-CHUNKING
+250 BINARYMIME
+250 Sender OK
+250 Receiver OK
+250 Message OK
+250 Sender OK
+`
+
+var binaryMIMEClient = `EHLO localhost
+MAIL FROM:<user@gmail.com> BODY=BINARYMIME
+RCPT TO:<golang-nuts@googlegroups.com>
+`
+
+func TestClientPipelining(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	// The client would wait for the replies the server doesn't send yet if
+	// the commands weren't pipelined
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	serverConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	received := make(chan string, 1)
+	go func() {
+		defer serverConn.Close()
+		defer close(received)
+		tc := textproto.NewConn(serverConn)
+		tc.PrintfLine("220 hello world")
+		tc.ReadLine()
+		tc.PrintfLine("250-mx.google.com at your service")
+		tc.PrintfLine("250 PIPELINING")
+		var cmds []string
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+			cmds = append(cmds, line)
+			if line == "DATA" {
+				break
+			}
+		}
+		tc.PrintfLine("250 Sender OK")
+		tc.PrintfLine("550 5.1.1 No such user")
+		tc.PrintfLine("250 Receiver OK")
+		tc.PrintfLine("354 Go ahead")
+		data, err := tc.ReadDotBytes()
+		if err != nil {
+			return
+		}
+		tc.PrintfLine("250 Data OK")
+		received <- strings.Join(cmds, "\n") + "\n" + string(data)
+	}()
+
+	c, err := NewClient(clientConn, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	rcptErrs, w, err := c.MailPipelined("user@gmail.com", nil, []string{"nobody@gmail.com", "golang-nuts@googlegroups.com"})
+	if err != nil {
+		t.Fatalf("MailPipelined failed: %s", err)
+	}
+	if smtpErr, ok := rcptErrs[0].(*SMTPError); !ok || smtpErr.Code != 550 || rcptErrs[1] != nil {
+		t.Fatalf("Invalid recipient errors: %v", rcptErrs)
+	}
+	io.WriteString(w, "Hello\r\n")
+	if err := w.Close(); err != nil {
+		t.Fatalf("Bad data response: %s", err)
+	}
+
+	expected := "MAIL FROM:<user@gmail.com>\nRCPT TO:<nobody@gmail.com>\nRCPT TO:<golang-nuts@googlegroups.com>\nDATA\nHello\n"
+	if cmds := <-received; cmds != expected {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", cmds, expected)
+	}
+}
+
+func TestClientPipelining_lockstep(t *testing.T) {
+	server := strings.Join(strings.Split(lockstepServer, "\n"), "\r\n")
+	client := strings.Join(strings.Split(lockstepClient, "\n"), "\r\n")
+
+	var cmdbuf bytes.Buffer
+	bcmdbuf := bufio.NewWriter(&cmdbuf)
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+	c := &Client{Text: textproto.NewConn(fake), localName: "localhost"}
+
+	rcptErrs, w, err := c.MailPipelined("user@gmail.com", nil, []string{"nobody@gmail.com", "noone@gmail.com"})
+	if err == nil || w != nil {
+		t.Fatal("MailPipelined should have failed without accepted recipients")
+	}
+	if len(rcptErrs) != 2 || rcptErrs[0] == nil || rcptErrs[1] == nil {
+		t.Fatalf("Invalid recipient errors: %v", rcptErrs)
+	}
+
+	bcmdbuf.Flush()
+	actualcmds := cmdbuf.String()
+	if client != actualcmds {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", actualcmds, client)
+	}
+}
+
+var lockstepServer = `250 mx.google.com at your service
+250 Sender OK
+550 No such user
+550 No such user
+`
+
+var lockstepClient = `EHLO localhost
+MAIL FROM:<user@gmail.com>
+RCPT TO:<nobody@gmail.com>
+RCPT TO:<noone@gmail.com>
+`
+
+func TestClientTransaction_LMTP(t *testing.T) {
+	server := strings.Join(strings.Split(transactionServer, "\n"), "\r\n")
+	client := strings.Join(strings.Split(transactionClient, "\n"), "\r\n")
+
+	var cmdbuf bytes.Buffer
+	bcmdbuf := bufio.NewWriter(&cmdbuf)
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+	c := &Client{Text: textproto.NewConn(fake), localName: "localhost", lmtp: true}
+
+	rcptErrs, err := c.Transaction("user@gmail.com", nil, []string{"nobody@gmail.com", "full@gmail.com", "golang-nuts@googlegroups.com"}, strings.NewReader("Hello\r\n"))
+	if err != nil {
+		t.Fatal("Transaction failed:", err)
+	}
+	if len(rcptErrs) != 3 {
+		t.Fatalf("Invalid number of recipient errors: %v", rcptErrs)
+	}
+	if smtpErr, ok := rcptErrs[0].(*SMTPError); !ok || smtpErr.Code != 550 {
+		t.Errorf("Invalid error of the rejected recipient: %v", rcptErrs[0])
+	}
+	if smtpErr, ok := rcptErrs[1].(*SMTPError); !ok || smtpErr.Code != 552 {
+		t.Errorf("Invalid error of the failed recipient: %v", rcptErrs[1])
+	}
+	if rcptErrs[2] != nil {
+		t.Errorf("Invalid error of the delivered recipient: %v", rcptErrs[2])
+	}
+
+	// All the statuses are read, so the next reply is the one of NOOP
+	if _, msg, err := c.cmd(250, "NOOP"); err != nil || msg != "NOOP OK" {
+		t.Fatalf("Invalid NOOP response: %s %v", msg, err)
+	}
+
+	bcmdbuf.Flush()
+	actualcmds := cmdbuf.String()
+	if client != actualcmds {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", actualcmds, client)
+	}
+}
+
+func TestClientTransaction_mailRejected(t *testing.T) {
+	server := strings.Join(strings.Split("250 localhost at your service\n550 5.1.8 Bad sender address\n", "\n"), "\r\n")
+
+	var cmdbuf bytes.Buffer
+	bcmdbuf := bufio.NewWriter(&cmdbuf)
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+	c := &Client{Text: textproto.NewConn(fake), localName: "localhost"}
+
+	rcptErrs, err := c.Transaction("user@gmail.com", nil, []string{"nobody@gmail.com", "golang-nuts@googlegroups.com"}, strings.NewReader("Hello\r\n"))
+	if smtpErr, ok := err.(*SMTPError); !ok || smtpErr.EnhancedCode != (EnhancedCode{5, 1, 8}) {
+		t.Fatalf("Invalid error of the transaction: %v", err)
+	}
+	if len(rcptErrs) != 2 || rcptErrs[0] != nil || rcptErrs[1] != nil {
+		t.Errorf("Rejected sender is reported for the recipients: %v", rcptErrs)
+	}
+}
+
+var transactionServer = `250 localhost at your service
+250 Sender OK
+550 5.1.1 No such user
+250 Receiver OK
+250 Receiver OK
+354 Go ahead
+552 5.2.2 Mailbox full
+250 Delivered
+250 NOOP OK
+`
+
+var transactionClient = `LHLO localhost
+MAIL FROM:<user@gmail.com>
+RCPT TO:<nobody@gmail.com>
+RCPT TO:<full@gmail.com>
+RCPT TO:<golang-nuts@googlegroups.com>
+DATA
+Hello
+.
+NOOP
+`
+
+func TestClientTranscript(t *testing.T) {
+	server := strings.Join(strings.Split(transcriptServer, "\n"), "\r\n")
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		// The server replies only after reading the commands in a real conversation
+		iotest.OneByteReader(strings.NewReader(server)),
+		&wrote,
+	}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	var transcript bytes.Buffer
+	c.Transcript = &transcript
+	if err := c.Auth(sasl.NewPlainClient("", "user", "secret")); err != nil {
+		t.Fatalf("AUTH failed: %s", err)
+	}
+	if err := c.Mail("user@gmail.com", nil); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	if !strings.Contains(wrote.String(), "AUTH PLAIN AHVzZXIAc2VjcmV0\r\n") {
+		t.Fatalf("Credentials are not sent: %q", wrote.String())
+	}
+	expected := strings.Join(strings.Split(transcriptClient, "\n"), "\r\n")
+	if transcript.String() != expected {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", transcript.String(), expected)
+	}
+}
+
+func TestClientTranscript_data(t *testing.T) {
+	tests := []struct {
+		name   string
+		server string
+		client string
+	}{
+		{"DATA", transcriptDataServer, transcriptDataClient},
+		{"BDAT", transcriptBdatServer, transcriptBdatClient},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := strings.Join(strings.Split(test.server, "\n"), "\r\n")
+			var wrote bytes.Buffer
+			var fake faker
+			fake.ReadWriter = struct {
+				io.Reader
+				io.Writer
+			}{
+				iotest.OneByteReader(strings.NewReader(server)),
+				&wrote,
+			}
+			c, err := NewClient(fake, "fake.host")
+			if err != nil {
+				t.Fatalf("NewClient: %v", err)
+			}
+			var transcript bytes.Buffer
+			c.Transcript = &transcript
+			if _, err := c.Transaction("user@gmail.com", nil, []string{"golang-nuts@googlegroups.com"}, strings.NewReader("Secret body\r\n")); err != nil {
+				t.Fatalf("Transaction failed: %s", err)
+			}
+			if err := c.Noop(); err != nil {
+				t.Fatalf("NOOP failed: %s", err)
+			}
+			if !strings.Contains(wrote.String(), "Secret body") {
+				t.Fatalf("Message is not sent: %q", wrote.String())
+			}
+			if strings.Contains(transcript.String(), "Secret body") {
+				t.Errorf("Message data is transcribed:\n%s", transcript.String())
+			}
+			expected := strings.Join(strings.Split(test.client, "\n"), "\r\n")
+			if transcript.String() != expected {
+				t.Fatalf("Got:\n%s\nExpected:\n%s", transcript.String(), expected)
+			}
+		})
+	}
+}
+
+var transcriptDataServer = `220 hello world
+250 mx.google.com at your service
+250 Sender OK
+250 Receiver OK
+354 Go ahead
+250 Data OK
+250 NOOP OK
+`
+
+var transcriptDataClient = `S: 220 hello world
+C: EHLO localhost
+S: 250 mx.google.com at your service
+C: MAIL FROM:<user@gmail.com>
+S: 250 Sender OK
+C: RCPT TO:<golang-nuts@googlegroups.com>
+S: 250 Receiver OK
+C: DATA
+S: 354 Go ahead
+C: <16 bytes of message data>
+S: 250 Data OK
+C: NOOP
+S: 250 NOOP OK
+`
+
+var transcriptBdatServer = `220 hello world
+250-mx.google.com at your service
+250 CHUNKING
+250 Sender OK
+250 Receiver OK
+250 Data OK
+250 NOOP OK
+`
+
+var transcriptBdatClient = `S: 220 hello world
+C: EHLO localhost
+S: 250-mx.google.com at your service
+S: 250 CHUNKING
+C: MAIL FROM:<user@gmail.com>
+S: 250 Sender OK
+C: RCPT TO:<golang-nuts@googlegroups.com>
+S: 250 Receiver OK
+C: BDAT 13 LAST
+C: <13 bytes of message data>
+S: 250 Data OK
+C: NOOP
+S: 250 NOOP OK
+`
+
+var transcriptServer = `220 hello world
+250-mx.google.com at your service
+250 AUTH PLAIN
+235 Accepted
+250 Sender OK
+`
+
+var transcriptClient = `S: 220 hello world
+C: EHLO localhost
+S: 250-mx.google.com at your service
+S: 250 AUTH PLAIN
+C: AUTH PLAIN <redacted>
+S: 235 Accepted
+C: MAIL FROM:<user@gmail.com>
+S: 250 Sender OK
+`
@@ -1,8 +1,10 @@
 package smtp
 
 import (
+	"bufio"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -32,7 +34,16 @@ type Conn struct {
 	locker    sync.Mutex
 
 	fromReceived bool
+	binaryMIME   bool
 	recipients   []string
+
+	// Message being received with BDAT commands (RFC 3030). The chunks are
+	// written to bdatPipe, the backend reads them in another goroutine and
+	// sends its result to bdatResult.
+	bdatPipe   *io.PipeWriter
+	bdatResult chan error
+	bdatStatus *statusCollector
+	bdatSize   int64
 }
 
 func newConn(c net.Conn, s *Server) *Conn {
@@ -46,15 +57,14 @@ func newConn(c net.Conn, s *Server) *Conn {
 }
 
 func (c *Conn) init() {
+	// The line length is limited while reading the lines rather than the
+	// connection, since BDAT chunks are not made of lines
 	rwc := struct {
 		io.Reader
 		io.Writer
 		io.Closer
 	}{
-		Reader: lineLimitReader{
-			R:         c.conn,
-			LineLimit: c.server.MaxLineLength,
-		},
+		Reader: c.conn,
 		Writer: c.conn,
 		Closer: c.conn,
 	}
@@ -133,6 +143,12 @@ func (c *Conn) handle(cmd string, arg string) {
 		c.WriteResponse(250, EnhancedCode{2, 0, 0}, "Session reset")
 	case "DATA":
 		c.handleData(arg)
+	case "BDAT":
+		if !c.server.EnableCHUNKING {
+			c.unrecognizedCommand(cmd)
+			return
+		}
+		c.handleBdat(arg)
 	case "QUIT":
 		c.WriteResponse(221, EnhancedCode{2, 0, 0}, "Goodnight and good luck")
 		c.Close()
@@ -246,6 +262,15 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 		if c.server.MaxMessageBytes > 0 {
 			caps = append(caps, fmt.Sprintf("SIZE %v", c.server.MaxMessageBytes))
 		}
+		if c.server.EnableDSN {
+			caps = append(caps, "DSN")
+		}
+		if c.server.EnableCHUNKING {
+			caps = append(caps, "CHUNKING")
+			if c.server.EnableBINARYMIME {
+				caps = append(caps, "BINARYMIME")
+			}
+		}
 
 		args := []string{"Hello " + domain}
 		args = append(args, caps...)
@@ -260,6 +285,11 @@ func (c *Conn) handleMail(arg string) {
 		return
 	}
 
+	if c.bdatPipe != nil {
+		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "MAIL not allowed during message transfer")
+		return
+	}
+
 	if c.Session() == nil {
 		state := c.State()
 		session, err := c.server.Backend.AnonymousLogin(&state)
@@ -295,8 +325,9 @@ func (c *Conn) handleMail(arg string) {
 
 	opts := MailOptions{}
 
-	// This is where the Conn may put BODY=8BITMIME, but we already
-	// read the DATA as bytes, so it does not effect our processing.
+	// BODY=8BITMIME does not effect our processing, since we already read
+	// the DATA as bytes. BODY=BINARYMIME requires the message to be sent
+	// with BDAT.
 	if len(fromArgs) > 1 {
 		args, err := parseArgs(fromArgs[1:])
 		if err != nil {
@@ -332,12 +363,42 @@ func (c *Conn) handleMail(arg string) {
 				}
 				opts.RequireTLS = true
 			case "BODY":
-				switch value {
-				case "7BIT", "8BITMIME":
+				switch body := BodyType(strings.ToUpper(value)); body {
+				case Body7Bit, Body8BitMIME:
+					opts.Body = body
+				case BodyBinaryMIME:
+					if !c.server.EnableBINARYMIME || !c.server.EnableCHUNKING {
+						c.WriteResponse(504, EnhancedCode{5, 5, 4}, "BINARYMIME is not implemented")
+						return
+					}
+					opts.Body = body
 				default:
 					c.WriteResponse(500, EnhancedCode{5, 5, 4}, "Unknown BODY value")
 					return
 				}
+			case "RET":
+				if !c.server.EnableDSN {
+					c.WriteResponse(504, EnhancedCode{5, 5, 4}, "RET is not implemented")
+					return
+				}
+				switch ret := DSNReturn(strings.ToUpper(value)); ret {
+				case DSNReturnFull, DSNReturnHeaders:
+					opts.Return = ret
+				default:
+					c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Unknown RET value")
+					return
+				}
+			case "ENVID":
+				if !c.server.EnableDSN {
+					c.WriteResponse(504, EnhancedCode{5, 5, 4}, "ENVID is not implemented")
+					return
+				}
+				envelopeID, err := decodeXtext(value)
+				if err != nil {
+					c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Malformed ENVID value")
+					return
+				}
+				opts.EnvelopeID = envelopeID
 			default:
 				c.WriteResponse(500, EnhancedCode{5, 5, 4}, "Unknown MAIL FROM argument")
 				return
@@ -356,6 +417,7 @@ func (c *Conn) handleMail(arg string) {
 
 	c.WriteResponse(250, EnhancedCode{2, 0, 0}, fmt.Sprintf("Roger, accepting mail from <%v>", from))
 	c.fromReceived = true
+	c.binaryMIME = opts.Body == BodyBinaryMIME
 }
 
 // MAIL state -> waiting for RCPTs followed by DATA
@@ -365,20 +427,91 @@ func (c *Conn) handleRcpt(arg string) {
 		return
 	}
 
+	if c.bdatPipe != nil {
+		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "RCPT not allowed during message transfer")
+		return
+	}
+
 	if (len(arg) < 4) || (strings.ToUpper(arg[0:3]) != "TO:") {
 		c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Was expecting RCPT arg syntax of TO:<address>")
 		return
 	}
 
+	toArgs := strings.Fields(arg[3:])
+	if len(toArgs) == 0 {
+		c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Was expecting RCPT arg syntax of TO:<address>")
+		return
+	}
 	// TODO: This trim is probably too forgiving
-	recipient := strings.Trim(arg[3:], "<> ")
+	recipient := strings.Trim(toArgs[0], "<> ")
 
 	if c.server.MaxRecipients > 0 && len(c.recipients) >= c.server.MaxRecipients {
 		c.WriteResponse(552, EnhancedCode{5, 5, 3}, fmt.Sprintf("Maximum limit of %v recipients reached", c.server.MaxRecipients))
 		return
 	}
 
-	if err := c.Session().Rcpt(recipient); err != nil {
+	opts := RcptOptions{}
+
+	if len(toArgs) > 1 {
+		args, err := parseArgs(toArgs[1:])
+		if err != nil {
+			c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Unable to parse RCPT ESMTP parameters")
+			return
+		}
+
+		for key, value := range args {
+			switch key {
+			case "NOTIFY":
+				if !c.server.EnableDSN {
+					c.WriteResponse(504, EnhancedCode{5, 5, 4}, "NOTIFY is not implemented")
+					return
+				}
+				notify := strings.Split(strings.ToUpper(value), ",")
+				for _, n := range notify {
+					switch DSNNotify(n) {
+					case DSNNotifyNever:
+						if len(notify) != 1 {
+							c.WriteResponse(501, EnhancedCode{5, 5, 4}, "NOTIFY=NEVER cannot be combined with other options")
+							return
+						}
+					case DSNNotifySuccess, DSNNotifyFailure, DSNNotifyDelayed:
+					default:
+						c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Unknown NOTIFY value")
+						return
+					}
+					opts.Notify = append(opts.Notify, DSNNotify(n))
+				}
+			case "ORCPT":
+				if !c.server.EnableDSN {
+					c.WriteResponse(504, EnhancedCode{5, 5, 4}, "ORCPT is not implemented")
+					return
+				}
+				parts := strings.SplitN(value, ";", 2)
+				if len(parts) != 2 || parts[0] == "" {
+					c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Malformed ORCPT value")
+					return
+				}
+				orcpt, err := decodeXtext(parts[1])
+				if err != nil {
+					c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Malformed ORCPT value")
+					return
+				}
+				opts.OriginalRecipientType = parts[0]
+				opts.OriginalRecipient = orcpt
+			default:
+				c.WriteResponse(500, EnhancedCode{5, 5, 4}, "Unknown RCPT TO argument")
+				return
+			}
+		}
+	}
+
+	var err error
+	if rcptSession, ok := c.Session().(RcptSession); ok {
+		err = rcptSession.RcptWithOptions(recipient, opts)
+	} else {
+		err = c.Session().Rcpt(recipient)
+	}
+	if err != nil {
 		if smtpErr, ok := err.(*SMTPError); ok {
 			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
 			return
@@ -506,6 +639,16 @@ func (c *Conn) handleData(arg string) {
 		return
 	}
 
+	if c.bdatPipe != nil {
+		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "DATA command cannot be used after BDAT")
+		return
+	}
+
+	if c.binaryMIME {
+		c.WriteResponse(503, EnhancedCode{5, 5, 1}, "BINARYMIME message must be sent with BDAT")
+		return
+	}
+
 	// We have recipients, go to accept data
 	c.WriteResponse(354, EnhancedCode{2, 0, 0}, "Go ahead. End your data with <CR><LF>.<CR><LF>")
 
@@ -565,9 +708,9 @@ func (s *statusCollector) SetStatus(rcptTo string, err error) {
 	}
 }
 
-func (c *Conn) handleDataLMTP() {
-	r := newDataReader(c)
-
+// newStatusCollector returns a statusCollector for the recipients of the
+// current transaction.
+func (c *Conn) newStatusCollector() *statusCollector {
 	rcptCounts := make(map[string]int, len(c.recipients))
 
 	status := &statusCollector{
@@ -585,6 +728,21 @@ func (c *Conn) handleDataLMTP() {
 	for _, rcpt := range c.recipients {
 		status.status = append(status.status, status.statusMap[rcpt])
 	}
+	return status
+}
+
+// writeStatus writes a response for each recipient, waiting for the statuses
+// that are not set yet.
+func (c *Conn) writeStatus(status *statusCollector) {
+	for i, rcpt := range c.recipients {
+		code, enchCode, msg := toSMTPStatus(<-status.status[i])
+		c.WriteResponse(code, enchCode, "<"+rcpt+"> "+msg)
+	}
+}
+
+func (c *Conn) handleDataLMTP() {
+	r := newDataReader(c)
+	status := c.newStatusCollector()
 
 	done := make(chan bool, 1)
 
@@ -619,10 +777,7 @@ func (c *Conn) handleDataLMTP() {
 		}()
 	}
 
-	for i, rcpt := range c.recipients {
-		code, enchCode, msg := toSMTPStatus(<-status.status[i])
-		c.WriteResponse(code, enchCode, "<"+rcpt+"> "+msg)
-	}
+	c.writeStatus(status)
 
 	// If done gets false, the panic occured in LMTPData and the connection
 	// should be closed.
@@ -631,6 +786,160 @@ func (c *Conn) handleDataLMTP() {
 	}
 }
 
+// errPanic is the result of a backend that panicked while reading BDAT chunks.
+var errPanic = &SMTPError{
+	Code:         421,
+	EnhancedCode: EnhancedCode{4, 0, 0},
+	Message:      "Internal server error",
+}
+
+// BDAT (RFC 3030)
+func (c *Conn) handleBdat(arg string) {
+	args := strings.Fields(arg)
+	if len(args) == 0 || len(args) > 2 {
+		c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Was expecting BDAT arg syntax of chunk-size [LAST]")
+		return
+	}
+
+	// ParseUint doesn't accept negative sizes
+	size, err := strconv.ParseUint(args[0], 10, 63)
+	if err != nil {
+		c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Unable to parse chunk size as an integer")
+		return
+	}
+	chunk := &io.LimitedReader{R: c.text.R, N: int64(size)}
+
+	last := false
+	if len(args) == 2 {
+		if !strings.EqualFold(args[1], "LAST") {
+			c.discardChunk(chunk)
+			c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Unknown BDAT argument")
+			return
+		}
+		last = true
+	}
+
+	if !c.fromReceived || len(c.recipients) == 0 {
+		c.discardChunk(chunk)
+		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "Missing RCPT TO command.")
+		return
+	}
+
+	// The limit applies to the whole message rather than each chunk
+	if c.server.MaxMessageBytes > 0 && c.bdatSize+chunk.N > int64(c.server.MaxMessageBytes) {
+		c.discardChunk(chunk)
+		c.WriteResponse(552, EnhancedCode{5, 3, 4}, "Max message size exceeded")
+		c.reset()
+		return
+	}
+
+	if c.bdatPipe == nil {
+		c.startBdat()
+	}
+
+	_, err = io.Copy(c.bdatPipe, chunk)
+	if err != nil {
+		// The backend panicked and stopped reading the message
+		c.discardChunk(chunk)
+	}
+	if chunk.N > 0 {
+		// The connection is broken in the middle of the chunk
+		c.abortBdat()
+		return
+	}
+	c.bdatSize += int64(size)
+
+	if !last && err == nil {
+		c.WriteResponse(250, EnhancedCode{2, 0, 0}, fmt.Sprintf("Continue, %v octets received", size))
+		return
+	}
+
+	c.bdatPipe.Close()
+	err = <-c.bdatResult
+	if c.bdatStatus != nil {
+		c.writeStatus(c.bdatStatus)
+	} else {
+		code, enhancedCode, msg := toSMTPStatus(err)
+		c.WriteResponse(code, enhancedCode, msg)
+	}
+	c.bdatPipe = nil
+	c.reset()
+
+	if err == errPanic {
+		c.Close()
+	}
+}
+
+// startBdat starts passing the message received with BDAT commands to the
+// backend as a single reader.
+func (c *Conn) startBdat() {
+	r, w := io.Pipe()
+	result := make(chan error, 1)
+	var status *statusCollector
+	if c.server.LMTP {
+		status = c.newStatusCollector()
+	}
+	session := c.Session()
+	recipients := c.recipients
+	// The line endings are converted as for DATA, so the backends get
+	// the same data whichever command is used, except for binary messages
+	var data io.Reader = r
+	if !c.binaryMIME {
+		data = &lfReader{r: bufio.NewReader(r)}
+	}
+
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				if status != nil {
+					status.fillRemaining(errPanic)
+				}
+				r.CloseWithError(errPanic)
+
+				stack := debug.Stack()
+				c.server.ErrorLog.Printf("panic serving %v: %v\n%s", c.State().RemoteAddr, err, stack)
+				result <- errPanic
+			}
+		}()
+
+		var err error
+		if lmtpSession, ok := session.(LMTPSession); ok && status != nil {
+			err = lmtpSession.LMTPData(data, status)
+			status.fillRemaining(err)
+		} else {
+			err = session.Data(data)
+			if status != nil {
+				// Fallback to using a single status for all recipients.
+				for _, rcpt := range recipients {
+					status.SetStatus(rcpt, err)
+				}
+			}
+		}
+		io.Copy(ioutil.Discard, r) // Make sure all the chunks are consumed
+		result <- err
+	}()
+
+	c.bdatPipe = w
+	c.bdatResult = result
+	c.bdatStatus = status
+}
+
+// abortBdat stops the message being received with BDAT commands, if any, and
+// waits for the backend to return.
+func (c *Conn) abortBdat() {
+	if c.bdatPipe == nil {
+		return
+	}
+	c.bdatPipe.CloseWithError(errors.New("smtp: message transfer aborted"))
+	<-c.bdatResult
+	c.bdatPipe = nil
+}
+
+// discardChunk reads the rest of a BDAT chunk that is not passed to the backend.
+func (c *Conn) discardChunk(chunk *io.LimitedReader) {
+	io.Copy(ioutil.Discard, chunk)
+}
+
 func toSMTPStatus(err error) (code int, enchCode EnhancedCode, msg string) {
 	if err != nil {
 		if smtperr, ok := err.(*SMTPError); ok {
@@ -688,10 +997,34 @@ func (c *Conn) ReadLine() (string, error) {
 		}
 	}
 
-	return c.text.ReadLine()
+	// The line is read byte by byte from the buffer, so that a line over the
+	// limit fails without waiting for its end
+	var line []byte
+	for {
+		b, err := c.text.R.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		if b == '\n' {
+			break
+		}
+		line = append(line, b)
+		if c.server.MaxLineLength > 0 && len(line) > c.server.MaxLineLength {
+			return "", ErrTooLongLine
+		}
+	}
+	return strings.TrimSuffix(string(line), "\r"), nil
 }
 
 func (c *Conn) reset() {
+	c.abortBdat()
+	c.bdatResult = nil
+	c.bdatStatus = nil
+	c.bdatSize = 0
+
 	c.locker.Lock()
 	defer c.locker.Unlock()
 
@@ -699,5 +1032,6 @@ func (c *Conn) reset() {
 		c.session.Reset()
 	}
 	c.fromReceived = false
+	c.binaryMIME = false
 	c.recipients = nil
 }
@@ -1,6 +1,7 @@
 package smtp
 
 import (
+	"bufio"
 	"io"
 )
 
@@ -50,7 +51,10 @@ type dataReader struct {
 
 func newDataReader(c *Conn) io.Reader {
 	dr := &dataReader{
-		r: c.text.DotReader(),
+		r: &lineLimitReader{
+			R:         c.text.DotReader(),
+			LineLimit: c.server.MaxLineLength,
+		},
 	}
 
 	if c.server.MaxMessageBytes > 0 {
@@ -78,3 +82,36 @@ func (r *dataReader) Read(b []byte) (n int, err error) {
 	}
 	return
 }
+
+// lfReader converts the CRLF line endings of a message received in BDAT
+// chunks to LF, as the DotReader does for a message received with DATA. Bare
+// CRs and LFs are kept.
+type lfReader struct {
+	r *bufio.Reader
+}
+
+func (r *lfReader) Read(b []byte) (n int, err error) {
+	for n < len(b) {
+		var c byte
+		c, err = r.r.ReadByte()
+		if err != nil {
+			break
+		}
+		if c == '\r' {
+			// The LF may be in the next chunk, so this waits for it
+			if next, _ := r.r.Peek(1); len(next) == 1 && next[0] == '\n' {
+				continue
+			}
+		}
+		b[n] = c
+		n++
+		if r.r.Buffered() == 0 {
+			// Don't wait for the next chunk while holding data
+			break
+		}
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return 0, err
+}
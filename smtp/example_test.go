@@ -13,8 +13,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/cevatbarisyilmaz/ms/smtp"
 	"github.com/emersion/go-sasl"
-	"github.com/emersion/go-smtp"
 )
 
 func ExampleDial() {
@@ -61,12 +61,12 @@ var (
 	recipients = []string{"foo@example.com"}
 )
 
-func ExampleSendMail_PlainAuth() {
+func ExampleSendMail_plainAuth() {
 	// hostname is used by PlainAuth to validate the TLS certificate.
 	hostname := "mail.example.com"
 	auth := sasl.NewPlainClient("", "user@example.com", "password")
 
-	err := smtp.SendMail(hostname+":25", auth, from, recipients, msg)
+	err := smtp.SendMail(hostname+":25", auth, from, recipients, msg, "localhost")
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -83,7 +83,7 @@ func ExampleSendMail() {
 		"Subject: discount Gophers!\r\n" +
 		"\r\n" +
 		"This is the email body.\r\n")
-	err := smtp.SendMail("mail.example.com:25", auth, "sender@example.org", to, msg)
+	err := smtp.SendMail("mail.example.com:25", auth, "sender@example.org", to, msg, "localhost")
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -2,6 +2,7 @@ package smtp
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -68,3 +69,42 @@ func parseHelloArgument(arg string) (string, error) {
 	}
 	return domain, nil
 }
+
+// encodeXtext encodes a string as xtext (RFC 3461 Section 4).
+func encodeXtext(raw string) string {
+	var sb strings.Builder
+	for i := 0; i < len(raw); i++ {
+		ch := raw[i]
+		if ch < '!' || ch > '~' || ch == '+' || ch == '=' {
+			fmt.Fprintf(&sb, "+%02X", ch)
+		} else {
+			sb.WriteByte(ch)
+		}
+	}
+	return sb.String()
+}
+
+// decodeXtext decodes a string encoded as xtext (RFC 3461 Section 4).
+func decodeXtext(encoded string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(encoded); i++ {
+		ch := encoded[i]
+		switch {
+		case ch == '+':
+			if i+2 >= len(encoded) {
+				return "", fmt.Errorf("Truncated xtext hexchar: %q", encoded)
+			}
+			b, err := strconv.ParseUint(encoded[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("Invalid xtext hexchar: %q", encoded[i:i+3])
+			}
+			sb.WriteByte(byte(b))
+			i += 2
+		case ch < '!' || ch > '~' || ch == '=':
+			return "", fmt.Errorf("Invalid xtext character: %q", ch)
+		default:
+			sb.WriteByte(ch)
+		}
+	}
+	return sb.String(), nil
+}
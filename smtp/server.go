@@ -53,6 +53,20 @@ type Server struct {
 	// Should be used only if backend supports it.
 	EnableREQUIRETLS bool
 
+	// Advertise DSN (RFC 3461) capability.
+	// Should be used only if backend supports it.
+	EnableDSN bool
+
+	// Advertise CHUNKING (RFC 3030) capability and accept the BDAT command.
+	// The messages received in BDAT chunks are passed to Session.Data in the
+	// same form as the ones received with DATA.
+	EnableCHUNKING bool
+
+	// Advertise BINARYMIME (RFC 3030) capability.
+	// Should be used only if backend supports it. BINARYMIME messages can only
+	// be sent with BDAT, so it requires EnableCHUNKING too.
+	EnableBINARYMIME bool
+
 	// If set, the AUTH command will not be advertised and authentication
 	// attempts will be rejected. This setting overrides AllowInsecureAuth.
 	AuthDisabled bool
@@ -127,6 +141,7 @@ func (s *Server) handleConn(c *Conn) error {
 	s.locker.Unlock()
 
 	defer func() {
+		c.abortBdat()
 		c.Close()
 
 		s.locker.Lock()
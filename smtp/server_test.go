@@ -2,6 +2,7 @@ package smtp_test
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"io"
 	"io/ioutil"
@@ -10,13 +11,15 @@ import (
 	"strings"
 	"testing"
 
-	"github.com/emersion/go-smtp"
+	"github.com/cevatbarisyilmaz/ms/smtp"
 )
 
 type message struct {
-	From string
-	To   []string
-	Data []byte
+	From     string
+	To       []string
+	Data     []byte
+	Opts     smtp.MailOptions
+	RcptOpts []smtp.RcptOptions
 }
 
 type backend struct {
@@ -87,6 +90,7 @@ func (s *session) Mail(from string, opts smtp.MailOptions) error {
 	}
 	s.Reset()
 	s.msg.From = from
+	s.msg.Opts = opts
 	return nil
 }
 
@@ -95,6 +99,11 @@ func (s *session) Rcpt(to string) error {
 	return nil
 }
 
+func (s *session) RcptWithOptions(to string, opts smtp.RcptOptions) error {
+	s.msg.RcptOpts = append(s.msg.RcptOpts, opts)
+	return s.Rcpt(to)
+}
+
 func (s *session) Data(r io.Reader) error {
 	if b, err := ioutil.ReadAll(r); err != nil {
 		return err
@@ -328,6 +337,106 @@ func TestServer8BITMIME(t *testing.T) {
 	return
 }
 
+func TestServerBINARYMIME(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	s.EnableCHUNKING = true
+	s.EnableBINARYMIME = true
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<alice@wonderland.book> BODY=BINARYMIME\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "503 ") {
+		t.Fatal("Invalid DATA response, expected an error but got:", scanner.Text())
+	}
+
+	io.WriteString(c, "BDAT 4\r\na\nb\x00")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+	io.WriteString(c, "BDAT 0\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+	io.WriteString(c, "BDAT 6 LAST\r\n\r\n.\r\n\xff")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	if len(be.messages) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+	if msg := be.messages[0]; msg.Opts.Body != smtp.BodyBinaryMIME || string(msg.Data) != "a\nb\x00\r\n.\r\n\xff" {
+		t.Fatal("Invalid mail:", msg.Opts.Body, msg.Data)
+	}
+}
+
+func TestServerBINARYMIME_large(t *testing.T) {
+	be, s, c, _ := testServer(t, func(s *smtp.Server) {
+		s.EnableCHUNKING = true
+		s.EnableBINARYMIME = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	// Several chunks of binary data with long runs without LF, bare CRs and LFs
+	// and lines that would end the message if it was sent with DATA
+	data := make([]byte, 200*1024)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	copy(data[1000:], strings.Repeat("\xff", 5000))
+	copy(data[70000:], "\r\n.\r\n\n\r")
+
+	client, err := smtp.NewClient(c, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcptErrs, err := client.Transaction("root@nsa.gov", &smtp.MailOptions{Body: smtp.BodyBinaryMIME}, []string{"root@gchq.gov.uk"}, bytes.NewReader(data))
+	if err != nil || rcptErrs[0] != nil {
+		t.Fatal("Transaction failed:", err, rcptErrs[0])
+	}
+
+	if len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+	msg := be.anonmsgs[0]
+	if msg.Opts.Body != smtp.BodyBinaryMIME || !bytes.Equal(msg.Data, data) {
+		t.Fatal("Invalid mail:", msg.Opts.Body, len(msg.Data))
+	}
+}
+
+func TestServerBINARYMIME_Disabled(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<alice@wonderland.book> BODY=BINARYMIME\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "504 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	// BINARYMIME messages can't be sent without CHUNKING
+	s.EnableBINARYMIME = true
+	io.WriteString(c, "MAIL FROM:<alice@wonderland.book> BODY=BINARYMIME\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "504 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
 func TestServer_BODYInvalidValue(t *testing.T) {
 	_, s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
@@ -404,6 +513,78 @@ func TestServerEmptyTo(t *testing.T) {
 	return
 }
 
+func TestServerDSN(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	s.EnableDSN = true
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> RET=HDRS ENVID=QQ+2B314\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk> NOTIFY=SUCCESS,DELAY ORCPT=rfc822;root+2Bspy@gchq.gov.uk\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@bnd.bund.de> NOTIFY=NEVER,FAILURE\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "501 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.messages) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+	msg := be.messages[0]
+	if msg.Opts.Return != smtp.DSNReturnHeaders || msg.Opts.EnvelopeID != "QQ+314" {
+		t.Fatal("Invalid MAIL options:", msg.Opts)
+	}
+	if len(msg.RcptOpts) != 1 {
+		t.Fatal("Invalid number of RCPT options:", msg.RcptOpts)
+	}
+	opts := msg.RcptOpts[0]
+	if len(opts.Notify) != 2 || opts.Notify[0] != smtp.DSNNotifySuccess || opts.Notify[1] != smtp.DSNNotifyDelayed {
+		t.Fatal("Invalid NOTIFY option:", opts.Notify)
+	}
+	if opts.OriginalRecipientType != "rfc822" || opts.OriginalRecipient != "root+spy@gchq.gov.uk" {
+		t.Fatal("Invalid ORCPT option:", opts.OriginalRecipientType, opts.OriginalRecipient)
+	}
+}
+
+func TestServerDSN_Disabled(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> RET=FULL\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "504 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk> NOTIFY=FAILURE\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "504 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+}
+
 func TestServer(t *testing.T) {
 	be, s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
@@ -547,6 +728,149 @@ func TestServer_tooLongMessage(t *testing.T) {
 	}
 }
 
+func TestServer_bdat(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	s.EnableCHUNKING = true
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+
+	io.WriteString(c, "BDAT 7\r\nHey <3\r")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "502 ") {
+		t.Fatal("Invalid DATA response, expected an error but got:", scanner.Text())
+	}
+
+	// The chunk isn't made of lines and isn't dot-stuffed
+	io.WriteString(c, "BDAT 13 LAST\r\n\n.\r\n"+strings.Repeat("A", 9))
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	if len(be.messages) != 1 || len(be.anonmsgs) != 0 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+	// The line endings are converted as for DATA, even across chunks
+	if string(be.messages[0].Data) != "Hey <3\n.\nAAAAAAAAA" {
+		t.Fatal("Invalid mail data:", string(be.messages[0].Data))
+	}
+
+	io.WriteString(c, "BDAT 5 LAST\r\nHello")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "502 ") {
+		t.Fatal("Invalid BDAT response, expected an error but got:", scanner.Text())
+	}
+
+	io.WriteString(c, "BDAT LAST\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "501 ") {
+		t.Fatal("Invalid BDAT response, expected an error but got:", scanner.Text())
+	}
+
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+}
+
+func TestServer_bdatDisabled(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t)
+	defer s.Close()
+	defer c.Close()
+
+	if caps["CHUNKING"] {
+		t.Fatal("CHUNKING is advertised without being enabled")
+	}
+
+	io.WriteString(c, "BDAT 0 LAST\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "500 ") {
+		t.Fatal("Invalid BDAT response, expected an error but got:", scanner.Text())
+	}
+}
+
+func TestServer_bdatLongLine(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	s.EnableCHUNKING = true
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+
+	// The chunks are not made of lines, so the line length is not limited
+	chunk := strings.Repeat("\xff", 5000)
+	io.WriteString(c, "BDAT 5000\r\n"+chunk+"BDAT 5000 LAST\r\n"+chunk)
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	if len(be.messages) != 1 || string(be.messages[0].Data) != chunk+chunk {
+		t.Fatal("Invalid sent messages:", len(be.messages))
+	}
+
+	io.WriteString(c, "NOOP "+strings.Repeat("A", 2000)+"\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "500 ") {
+		t.Fatal("Invalid response, expected an error but got:", scanner.Text())
+	}
+}
+
+func TestServer_bdatTooLongMessage(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	s.EnableCHUNKING = true
+	defer s.Close()
+	defer c.Close()
+
+	s.MaxMessageBytes = 50
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+
+	io.WriteString(c, "BDAT 30\r\n"+strings.Repeat("A", 30))
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "BDAT 30 LAST\r\n"+strings.Repeat("A", 30))
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "552 ") {
+		t.Fatal("Invalid BDAT response, expected an error but got:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "502 ") {
+		t.Fatal("Transaction is not reset:", scanner.Text())
+	}
+
+	if len(be.messages) != 0 || len(be.anonmsgs) != 0 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+}
+
 func TestServer_tooLongLine(t *testing.T) {
 	_, s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
@@ -567,7 +891,7 @@ func TestServer_anonymousUserError(t *testing.T) {
 
 	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
 	scanner.Scan()
-	if scanner.Text() != "502 5.7.0 Please authenticate first" {
+	if scanner.Text() != "502 5.7.0 please authenticate first" {
 		t.Fatal("Backend refused anonymous mail but client was permitted:", scanner.Text())
 	}
 }
@@ -0,0 +1,114 @@
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Prefixes of the lines in the transcripts of clients
+const (
+	prefixClient = "C: "
+	prefixServer = "S: "
+)
+
+// transcriptWriter splits one side of the conversation into lines for the transcript of the client.
+type transcriptWriter struct {
+	c      *Client
+	prefix string
+	line   []byte
+}
+
+func (w *transcriptWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if w.prefix == prefixClient && w.c.sendingData {
+		w.c.dataSize += n
+		return n, nil
+	}
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			w.line = append(w.line, p...)
+			break
+		}
+		w.line = append(w.line, p[:i+1]...)
+		w.c.transcribe(w.prefix, w.line)
+		w.line = w.line[:0]
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// textConn returns the textproto connection over conn that is captured in the transcript.
+func (c *Client) textConn(conn net.Conn) io.ReadWriteCloser {
+	return struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{
+		Reader: io.TeeReader(&lineLimitReader{
+			R: conn,
+			// Doubled maximum line length per RFC 5321 (Section 4.5.3.1.6)
+			LineLimit: 2000,
+		}, &transcriptWriter{c: c, prefix: prefixServer}),
+		Writer: io.MultiWriter(conn, &transcriptWriter{c: c, prefix: prefixClient}),
+		Closer: conn,
+	}
+}
+
+// transcribe writes a line of the conversation to the transcript.
+// The lines before the greeting is read are kept for the transcript to be set later.
+func (c *Client) transcribe(prefix string, line []byte) {
+	if prefix == prefixClient && c.authenticating {
+		line = redactAuth(line)
+	}
+	if c.Transcript == nil {
+		if !c.greeted {
+			c.greeting = append(c.greeting, prefix...)
+			c.greeting = append(c.greeting, line...)
+		}
+		return
+	}
+	if c.greeting != nil {
+		c.Transcript.Write(c.greeting)
+		c.greeting = nil
+	}
+	c.Transcript.Write(append([]byte(prefix), line...))
+}
+
+// startData stops transcribing the lines sent by the client, the message data
+// written until endData is only counted.
+func (c *Client) startData() {
+	c.sendingData = true
+	c.dataSize = 0
+}
+
+// endData writes the size of the message data sent since startData to the
+// transcript in place of the data.
+func (c *Client) endData() {
+	if !c.sendingData {
+		return
+	}
+	c.sendingData = false
+	c.transcribe(prefixClient, []byte(fmt.Sprintf("<%d bytes of message data>\r\n", c.dataSize)))
+}
+
+// redactAuth hides the credentials in a line sent during authentication.
+// The mechanism of the AUTH command is kept.
+func redactAuth(line []byte) []byte {
+	fields := bytes.Fields(line)
+	if len(fields) >= 2 && bytes.EqualFold(fields[0], []byte("AUTH")) {
+		redacted := []byte("AUTH ")
+		redacted = append(redacted, fields[1]...)
+		if len(fields) > 2 {
+			redacted = append(redacted, " <redacted>"...)
+		}
+		return append(redacted, "\r\n"...)
+	}
+	if len(fields) == 1 && bytes.Equal(fields[0], []byte("*")) {
+		// Cancellation of the exchange doesn't carry credentials
+		return line
+	}
+	return []byte("<redacted>\r\n")
+}
@@ -0,0 +1,125 @@
+package smtptest
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// AssertDelivered fails the test if no mail is captured for the recipient
+// It returns the last mail captured for the recipient
+func (s *Server) AssertDelivered(t testing.TB, recipient string) *Message {
+	t.Helper()
+	messages := s.MessagesTo(recipient)
+	if len(messages) == 0 {
+		t.Fatalf("smtptest: no mail is delivered to %s", recipient)
+		return nil
+	}
+	return messages[len(messages)-1]
+}
+
+// AssertNotDelivered fails the test if a mail is captured for the recipient
+func (s *Server) AssertNotDelivered(t testing.TB, recipient string) {
+	t.Helper()
+	if messages := s.MessagesTo(recipient); len(messages) != 0 {
+		t.Fatalf("smtptest: %d mails are delivered to %s", len(messages), recipient)
+	}
+}
+
+// AssertCount fails the test unless exactly n mails are captured
+func (s *Server) AssertCount(t testing.TB, n int) {
+	t.Helper()
+	if messages := s.Messages(); len(messages) != n {
+		t.Fatalf("smtptest: %d mails are delivered, expected %d", len(messages), n)
+	}
+}
+
+// AssertHeader fails the test unless the header of the mail has the value
+func AssertHeader(t testing.TB, m *Message, key string, value string) {
+	t.Helper()
+	if actual := m.Header(key); actual != value {
+		t.Fatalf("smtptest: %s header is %q, expected %q", key, actual, value)
+	}
+}
+
+// AssertSigned fails the test unless the mail has a DKIM signature of the domain with the body hash of the mail
+// The signature itself isn't verified since that requires the public key of the domain in DNS
+func AssertSigned(t testing.TB, m *Message, domain string) {
+	t.Helper()
+	value := m.Header("DKIM-Signature")
+	if value == "" {
+		t.Fatal("smtptest: mail doesn't have a DKIM signature")
+		return
+	}
+	tags := parseTags(value)
+	if !strings.EqualFold(tags["d"], domain) {
+		t.Fatalf("smtptest: DKIM signature is of %q, expected %q", tags["d"], domain)
+		return
+	}
+	if !strings.Contains(strings.ToLower(":"+tags["h"]+":"), ":from:") {
+		t.Fatal("smtptest: DKIM signature doesn't cover the From header")
+		return
+	}
+	var h hash.Hash
+	switch tags["a"] {
+	case "rsa-sha1":
+		h = sha1.New()
+	default:
+		h = sha256.New()
+	}
+	bodyCanonicalization := "simple"
+	if parts := strings.SplitN(tags["c"], "/", 2); len(parts) == 2 {
+		bodyCanonicalization = parts[1]
+	}
+	body := m.Data
+	if i := bytes.Index(body, []byte("\r\n\r\n")); i >= 0 {
+		body = body[i+4:]
+	} else {
+		body = nil
+	}
+	h.Write(canonicalBody(body, bodyCanonicalization == "relaxed"))
+	if bh := base64.StdEncoding.EncodeToString(h.Sum(nil)); bh != tags["bh"] {
+		t.Fatal("smtptest: body hash of the DKIM signature doesn't match the body")
+	}
+}
+
+var whitespace = regexp.MustCompile(`\s+`)
+
+// parseTags parses the tag list of a DKIM signature
+func parseTags(value string) map[string]string {
+	tags := map[string]string{}
+	for _, tag := range strings.Split(value, ";") {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		tags[strings.TrimSpace(parts[0])] = whitespace.ReplaceAllString(parts[1], "")
+	}
+	return tags
+}
+
+// canonicalBody canonicalizes the body as in RFC 6376 Section 3.4
+func canonicalBody(body []byte, relaxed bool) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	if relaxed {
+		for i, line := range lines {
+			line = strings.TrimRight(line, " \t")
+			lines[i] = whitespace.ReplaceAllString(line, " ")
+		}
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if relaxed {
+			return nil
+		}
+		return []byte("\r\n")
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
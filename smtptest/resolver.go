@@ -0,0 +1,53 @@
+package smtptest
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Resolver is a fake ms.Resolver that points every domain at a single address
+// Each domain has a single MX host named "mx.<domain>" unless MX records are set for it
+type Resolver struct {
+	// IP is the address of all the hosts
+	IP net.IP
+
+	mu  sync.Mutex
+	mxs map[string][]*net.MX
+}
+
+// SetMX sets the MX records of the domain, no records make the lookups fail as if the domain has no MX hosts
+func (r *Resolver) SetMX(domain string, mxs ...*net.MX) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mxs == nil {
+		r.mxs = map[string][]*net.MX{}
+	}
+	r.mxs[strings.ToLower(strings.TrimSuffix(domain, "."))] = mxs
+}
+
+// LookupMX returns the MX records of the domain
+func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	domain := strings.ToLower(strings.TrimSuffix(name, "."))
+	r.mu.Lock()
+	mxs, ok := r.mxs[domain]
+	r.mu.Unlock()
+	if !ok {
+		return []*net.MX{{Host: "mx." + domain + ".", Pref: 10}}, nil
+	}
+	if len(mxs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return mxs, nil
+}
+
+// LookupIPAddr returns the address of the resolver for any host
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return []net.IPAddr{{IP: r.IP}}, nil
+}
+
+// LookupAddr fails for any address, so the service introduces itself with its domain
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
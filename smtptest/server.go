@@ -0,0 +1,267 @@
+// Package smtptest provides utilities for end-to-end testing of the code sending mails with ms
+//
+// A Server captures the mails sent to it and a Resolver points every domain at it,
+// so that ms.Service delivers the mails to the server instead of the real MX hosts:
+//
+//	srv := smtptest.NewServer()
+//	defer srv.Close()
+//	service := ms.New("example.org", "default", privateKey)
+//	srv.Configure(service)
+//	srv.Script("full@example.com", smtptest.TempFail)
+//	service.Send(mail)
+//	srv.AssertDelivered(t, "joe@example.com")
+package smtptest
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/cevatbarisyilmaz/ms"
+	"github.com/cevatbarisyilmaz/ms/smtp"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+)
+
+// Response is the scripted reply of the server to a recipient
+type Response struct {
+	// Code is the SMTP reply code, 0 accepts the recipient
+	Code         int
+	EnhancedCode smtp.EnhancedCode
+	Message      string
+	// Drop closes the connection instead of replying
+	Drop bool
+}
+
+var (
+	// Accept accepts the recipient
+	Accept = Response{}
+	// TempFail rejects the recipient temporarily
+	TempFail = Response{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 2, 0}, Message: "Mailbox temporarily unavailable"}
+	// PermFail rejects the recipient permanently
+	PermFail = Response{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	// Drop closes the connection when the recipient is given
+	Drop = Response{Drop: true}
+)
+
+// Message is a mail captured by the server
+type Message struct {
+	From string
+	To   []string
+	Opts smtp.MailOptions
+	// Data is the raw mail as received including the DKIM signature, its lines end with CRLF
+	Data []byte
+}
+
+// Header returns the value of the header of the mail, it is empty if the mail doesn't have the header
+func (m *Message) Header(key string) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(m.Data))
+	if err != nil {
+		return ""
+	}
+	return msg.Header.Get(key)
+}
+
+// Server is an in-process SMTP server that captures the mails sent to it
+type Server struct {
+	// Addr is the address the server listens on such as "127.0.0.1:34567"
+	Addr string
+	// SMTP is the underlying server, it can be configured before Start is called
+	SMTP *smtp.Server
+
+	listener  net.Listener
+	mu        sync.Mutex
+	messages  []*Message
+	responses map[string][]Response
+}
+
+// NewServer returns a started Server listening on a random port of the loopback interface
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a Server that is not started yet, so its SMTP server can be configured
+// The caller should call Start when the configuration is done
+func NewUnstartedServer() *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("smtptest: failed to listen on a port: %v", err))
+	}
+	s := &Server{
+		Addr:      l.Addr().String(),
+		listener:  l,
+		responses: map[string][]Response{},
+	}
+	s.SMTP = smtp.NewServer(&backend{s: s})
+	s.SMTP.Domain = "localhost"
+	s.SMTP.ErrorLog = nopLogger{}
+	return s
+}
+
+// Start starts serving the connections
+func (s *Server) Start() {
+	go s.SMTP.Serve(s.listener)
+}
+
+// Close stops the server and closes its connections
+func (s *Server) Close() {
+	s.SMTP.Close()
+}
+
+// Port returns the port the server listens on
+func (s *Server) Port() string {
+	_, port, _ := net.SplitHostPort(s.Addr)
+	return port
+}
+
+// Resolver returns a Resolver pointing every domain at the server
+func (s *Server) Resolver() *Resolver {
+	host, _, _ := net.SplitHostPort(s.Addr)
+	return &Resolver{IP: net.ParseIP(host)}
+}
+
+// Configure makes the service deliver all mails to the server
+func (s *Server) Configure(service *ms.Service) {
+	service.Resolver = s.Resolver()
+	service.Port = s.Port()
+}
+
+// Script sets the replies to the recipient for the following attempts in order
+// The last reply is repeated for the later attempts, unscripted recipients are accepted
+func (s *Server) Script(recipient string, responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses[strings.ToLower(recipient)] = responses
+}
+
+// Messages returns the captured mails in the order they are received
+func (s *Server) Messages() []*Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Message(nil), s.messages...)
+}
+
+// MessagesTo returns the captured mails to the recipient
+func (s *Server) MessagesTo(recipient string) []*Message {
+	var messages []*Message
+	for _, m := range s.Messages() {
+		for _, to := range m.To {
+			if strings.EqualFold(to, recipient) {
+				messages = append(messages, m)
+				break
+			}
+		}
+	}
+	return messages
+}
+
+// Reset discards the captured mails and the scripted replies
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = nil
+	s.responses = map[string][]Response{}
+}
+
+// response returns the reply to the recipient for the current attempt
+func (s *Server) response(recipient string) Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := strings.ToLower(recipient)
+	responses := s.responses[key]
+	if len(responses) == 0 {
+		return Accept
+	}
+	if len(responses) > 1 {
+		s.responses[key] = responses[1:]
+	}
+	return responses[0]
+}
+
+func (s *Server) capture(m *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, m)
+}
+
+// drop closes the connection from the remote address
+func (s *Server) drop(remote net.Addr) {
+	var conns []*smtp.Conn
+	s.SMTP.ForEachConn(func(c *smtp.Conn) {
+		if c.State().RemoteAddr.String() == remote.String() {
+			conns = append(conns, c)
+		}
+	})
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+type backend struct {
+	s *Server
+}
+
+func (b *backend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	return &session{s: b.s, remote: state.RemoteAddr}, nil
+}
+
+func (b *backend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	return &session{s: b.s, remote: state.RemoteAddr}, nil
+}
+
+type session struct {
+	s      *Server
+	remote net.Addr
+	msg    *Message
+}
+
+func (s *session) Reset() {
+	s.msg = nil
+}
+
+func (s *session) Logout() error {
+	return nil
+}
+
+func (s *session) Mail(from string, opts smtp.MailOptions) error {
+	s.msg = &Message{From: from, Opts: opts}
+	return nil
+}
+
+func (s *session) Rcpt(to string) error {
+	response := s.s.response(to)
+	if response.Drop {
+		s.s.drop(s.remote)
+		return &smtp.SMTPError{Code: 421, EnhancedCode: smtp.EnhancedCode{4, 4, 2}, Message: "Connection dropped"}
+	}
+	if response.Code != 0 {
+		return &smtp.SMTPError{Code: response.Code, EnhancedCode: response.EnhancedCode, Message: response.Message}
+	}
+	s.msg.To = append(s.msg.To, to)
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	// The line endings are converted to LF while reading the data, except for binary messages
+	s.msg.Data = data
+	if s.msg.Opts.Body != smtp.BodyBinaryMIME {
+		s.msg.Data = bytes.Replace(data, []byte("\n"), []byte("\r\n"), -1)
+	}
+	s.s.capture(s.msg)
+	s.msg = nil
+	return nil
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, v ...interface{}) {}
+
+func (nopLogger) Println(v ...interface{}) {}
@@ -0,0 +1,239 @@
+package smtptest_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/cevatbarisyilmaz/ms"
+	"github.com/cevatbarisyilmaz/ms/smtp"
+	"github.com/cevatbarisyilmaz/ms/smtptest"
+	"strings"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := smtptest.NewServer()
+	defer srv.Close()
+	service := ms.New("example.org", "default", privateKey)
+	srv.Configure(service)
+	srv.Script("full@example.com", smtptest.TempFail)
+	srv.Script("nobody@example.com", smtptest.PermFail)
+	srv.Script("flaky@example.net", smtptest.Drop, smtptest.Accept)
+
+	report, err := service.Deliver(&ms.Mail{
+		Headers: map[string][]byte{
+			"From":    []byte("joe@example.org"),
+			"To":      []byte("jane@example.com, full@example.com, nobody@example.com, flaky@example.net"),
+			"Subject": []byte("Hello"),
+		},
+		Body: []byte("Hello  there \r\n\r\n"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]ms.Status{
+		"jane@example.com":   ms.Delivered,
+		"full@example.com":   ms.Deferred,
+		"nobody@example.com": ms.Failed,
+		"flaky@example.net":  ms.Deferred,
+	}
+	for recipient, status := range expected {
+		if result := report.Recipients[recipient]; result.Status != status {
+			t.Errorf("%s is %v, expected %v: %v", recipient, result.Status, status, result.Err)
+		}
+	}
+
+	m := srv.AssertDelivered(t, "jane@example.com")
+	if m.From != "joe@example.org" {
+		t.Error("Invalid envelope sender:", m.From)
+	}
+	smtptest.AssertHeader(t, m, "Subject", "Hello")
+	smtptest.AssertHeader(t, m, "Message-ID", report.MessageID)
+	smtptest.AssertSigned(t, m, "example.org")
+	srv.AssertNotDelivered(t, "full@example.com")
+	srv.AssertNotDelivered(t, "nobody@example.com")
+	srv.AssertNotDelivered(t, "flaky@example.net")
+
+	// The connection is dropped only once
+	report, err = service.Deliver(&ms.Mail{
+		Headers: map[string][]byte{
+			"From": []byte("joe@example.org"),
+			"To":   []byte("flaky@example.net"),
+		},
+		Body: []byte("Hello again"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := report.Recipients["flaky@example.net"]; result.Status != ms.Delivered {
+		t.Error("Retry failed:", result.Err)
+	}
+	srv.AssertDelivered(t, "flaky@example.net")
+	srv.AssertCount(t, 2)
+}
+
+func TestServer_internationalized(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mail := &ms.Mail{
+		Headers: map[string][]byte{
+			"From":    []byte("joe@example.org"),
+			"To":      []byte("jöe@bücher.example, ann@bücher.example"),
+			"Subject": []byte("Hello"),
+		},
+		Body: []byte("Hello"),
+	}
+
+	srv := smtptest.NewUnstartedServer()
+	srv.SMTP.EnableSMTPUTF8 = true
+	srv.Start()
+	defer srv.Close()
+	service := ms.New("example.org", "default", privateKey)
+	srv.Configure(service)
+	report, err := service.Deliver(mail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Errors()) != 0 {
+		t.Fatal("Delivery failed:", report.Errors())
+	}
+	m := srv.AssertDelivered(t, "jöe@xn--bcher-kva.example")
+	if !m.Opts.UTF8 {
+		t.Error("SMTPUTF8 is not requested")
+	}
+
+	legacy := smtptest.NewServer()
+	defer legacy.Close()
+	legacy.Configure(service)
+	report, err = service.Deliver(mail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := report.Recipients["jöe@bücher.example"]; result.Status != ms.Failed || result.Err != ms.ErrSMTPUTF8Required {
+		t.Errorf("Invalid result of the non-ASCII recipient: %v %v", result.Status, result.Err)
+	}
+	if result := report.Recipients["ann@bücher.example"]; result.Status != ms.Delivered {
+		t.Error("ASCII recipient failed:", result.Err)
+	}
+	m = legacy.AssertDelivered(t, "ann@xn--bcher-kva.example")
+	if m.Opts.UTF8 {
+		t.Error("SMTPUTF8 is requested from a server that doesn't support it")
+	}
+	legacy.AssertCount(t, 1)
+}
+
+func TestServer_size(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := smtptest.NewUnstartedServer()
+	srv.SMTP.MaxMessageBytes = 100
+	srv.Start()
+	defer srv.Close()
+	service := ms.New("example.org", "default", privateKey)
+	srv.Configure(service)
+	report, err := service.Deliver(&ms.Mail{
+		Headers: map[string][]byte{
+			"From": []byte("joe@example.org"),
+			"To":   []byte("jane@example.com"),
+		},
+		Body: []byte("Hello"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := report.Recipients["jane@example.com"]
+	if smtpErr, ok := result.Err.(*smtp.SMTPError); result.Status != ms.Failed || !ok || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 3, 4}) {
+		t.Errorf("Too large mail is not rejected: %v %v", result.Status, result.Err)
+	}
+	srv.AssertCount(t, 0)
+}
+
+func TestServer_relay(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := smtptest.NewServer()
+	defer srv.Close()
+	srv.Script("nobody@example.net", smtptest.PermFail)
+	service := ms.New("example.org", "default", privateKey)
+	service.Transport = &ms.RelayTransport{Addr: srv.Addr, LocalName: "mail.example.org"}
+	service.Transcripts = true
+	report, err := service.Deliver(&ms.Mail{
+		Headers: map[string][]byte{
+			"From":         []byte("joe@example.org"),
+			"To":           []byte("jane@example.com, nobody@example.net"),
+			"Subject":      []byte("Hello"),
+			"Content-Type": []byte("text/plain; charset=utf-8"),
+		},
+		Body: []byte("Grüße"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := report.Recipients["jane@example.com"]
+	if result.Status != ms.Delivered {
+		t.Fatal("Delivery failed:", result.Err)
+	}
+	if len(result.Attempts) != 1 || !strings.Contains(result.Attempts[0].Transcript, "EHLO mail.example.org") {
+		t.Error("Invalid attempts:", result.Attempts)
+	}
+	if result := report.Recipients["nobody@example.net"]; result.Status != ms.Failed {
+		t.Errorf("Rejected recipient is %v: %v", result.Status, result.Err)
+	}
+	m := srv.AssertDelivered(t, "jane@example.com")
+	if m.Opts.Body != smtp.Body8BitMIME {
+		t.Errorf("Invalid body type: %q", m.Opts.Body)
+	}
+	smtptest.AssertSigned(t, m, "example.org")
+	srv.AssertCount(t, 1)
+}
+
+func TestServer_LMTP(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := smtptest.NewUnstartedServer()
+	srv.SMTP.LMTP = true
+	srv.Start()
+	defer srv.Close()
+	srv.Script("full@example.com", smtptest.TempFail)
+	service := ms.New("example.org", "default", privateKey)
+	service.Transport = &ms.LMTPTransport{Network: "tcp", Addr: srv.Addr}
+	report, err := service.Deliver(&ms.Mail{
+		Headers: map[string][]byte{
+			"From":    []byte("joe@example.org"),
+			"To":      []byte("jane@example.com, ann@example.net, full@example.com"),
+			"Subject": []byte("Hello"),
+		},
+		Body: []byte("Hello"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]ms.Status{
+		"jane@example.com": ms.Delivered,
+		"ann@example.net":  ms.Delivered,
+		"full@example.com": ms.Deferred,
+	}
+	for recipient, status := range expected {
+		if result := report.Recipients[recipient]; result.Status != status {
+			t.Errorf("%s is %v, expected %v: %v", recipient, result.Status, status, result.Err)
+		}
+	}
+	// The recipients of all domains are handed over in a single transaction
+	m := srv.AssertDelivered(t, "jane@example.com")
+	if len(m.To) != 2 {
+		t.Error("Invalid recipients:", m.To)
+	}
+	smtptest.AssertSigned(t, m, "example.org")
+	srv.AssertCount(t, 1)
+}
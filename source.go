@@ -0,0 +1,94 @@
+package ms
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+)
+
+// SourceAddr is a local address to send mails from
+type SourceAddr struct {
+	IP net.IP
+	// Hostname is the name to introduce the service with in EHLO, it should match the PTR record of the IP
+	// If it is empty, the PTR record of the IP is used and the domain of the service is the fallback
+	Hostname string
+}
+
+// IPPool is a named set of local addresses such as the ones for transactional or marketing mails
+// The addresses are used in turns for each connection
+type IPPool struct {
+	Name  string
+	Addrs []*SourceAddr
+
+	mu   sync.Mutex
+	next int
+}
+
+// NewIPPool returns an IPPool of the given IP addresses which use their PTR records as host names
+func NewIPPool(name string, ips ...net.IP) *IPPool {
+	pool := &IPPool{Name: name}
+	for _, ip := range ips {
+		pool.Addrs = append(pool.Addrs, &SourceAddr{IP: ip})
+	}
+	return pool
+}
+
+// addr returns the next address of the pool in the same family with the remote address
+// It returns nil if the pool doesn't have such an address
+func (p *IPPool) addr(remote net.IP) *SourceAddr {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := 0; i < len(p.Addrs); i++ {
+		addr := p.Addrs[p.next%len(p.Addrs)]
+		p.next++
+		if (addr.IP.To4() != nil) == (remote.To4() != nil) {
+			return addr
+		}
+	}
+	return nil
+}
+
+// pool returns the IP pool with the given name or the default pool of the service if the name is empty
+// It returns nil if no pool is selected so that the kernel picks the local address
+func (s *Service) pool(name string) (*IPPool, bool) {
+	if name == "" {
+		name = s.Pool
+	}
+	if name == "" {
+		return nil, true
+	}
+	pool, ok := s.Pools[name]
+	return pool, ok
+}
+
+// hostname returns the name to introduce the service with when sending from the address
+func (s *Service) hostname(addr *SourceAddr) string {
+	if addr == nil {
+		return s.domain
+	}
+	if addr.Hostname != "" {
+		return addr.Hostname
+	}
+	key := addr.IP.String()
+	s.hostnamesMu.Lock()
+	hostname, ok := s.hostnames[key]
+	s.hostnamesMu.Unlock()
+	if ok {
+		return hostname
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	names, err := s.resolver().LookupAddr(ctx, key)
+	cancel()
+	if err != nil || len(names) == 0 {
+		return s.domain
+	}
+	hostname = strings.TrimSuffix(names[0], ".")
+	s.hostnamesMu.Lock()
+	s.hostnames[key] = hostname
+	s.hostnamesMu.Unlock()
+	return hostname
+}
@@ -0,0 +1,39 @@
+package ms
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPPool(t *testing.T) {
+	pool := NewIPPool("marketing", net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"))
+	pool.Addrs[1].Hostname = "mta2.example.org"
+	s := &Service{
+		Pools: map[string]*IPPool{"marketing": pool},
+	}
+	if p, ok := s.pool(""); !ok || p != nil {
+		t.Error("A pool is selected without a default pool")
+	}
+	s.Pool = "marketing"
+	if p, ok := s.pool(""); !ok || p != pool {
+		t.Error("Default pool is not selected")
+	}
+	if _, ok := s.pool("transactional"); ok {
+		t.Error("Unknown pool is selected")
+	}
+	remote := net.ParseIP("198.51.100.1")
+	first, second, third := pool.addr(remote), pool.addr(remote), pool.addr(remote)
+	if !first.IP.Equal(net.ParseIP("192.0.2.1")) || !second.IP.Equal(net.ParseIP("192.0.2.2")) || third != first {
+		t.Error("Addresses are not used in turns:", first.IP, second.IP, third.IP)
+	}
+	if addr := pool.addr(net.ParseIP("2001:db8::1")); addr != nil {
+		t.Error("IPv4 address is selected for an IPv6 remote:", addr.IP)
+	}
+	if hostname := s.hostname(second); hostname != "mta2.example.org" {
+		t.Error("Invalid host name:", hostname)
+	}
+	var empty *IPPool
+	if empty.addr(remote) != nil {
+		t.Error("Nil pool returned an address")
+	}
+}
@@ -0,0 +1,284 @@
+package ms
+
+import (
+	"encoding/json"
+	"github.com/cevatbarisyilmaz/ms/smtp"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrSuppressed is reported for the recipients that are skipped because they are in the suppression list
+var ErrSuppressed = errors.New("recipient is suppressed")
+
+// Reasons of the suppressions
+const (
+	// SuppressionBounce is used for the recipients that failed permanently
+	SuppressionBounce = "bounce"
+	// SuppressionComplaint is used for the recipients that marked a mail as spam
+	SuppressionComplaint = "complaint"
+	// SuppressionManual is used for the recipients that are suppressed by hand
+	SuppressionManual = "manual"
+)
+
+// Suppression is an entry of a suppression list
+type Suppression struct {
+	// Recipient is the suppressed email address
+	Recipient string
+	// Reason is why the recipient is suppressed, such as SuppressionBounce
+	Reason string
+	// Diagnostic is the explanation of the suppression, such as the reply of the remote SMTP server
+	Diagnostic string `json:",omitempty"`
+	Created    time.Time
+	// Expires is the time the suppression ends, zero value means never
+	Expires time.Time `json:",omitempty"`
+}
+
+func (s *Suppression) expired(now time.Time) bool {
+	return !s.Expires.IsZero() && !now.Before(s.Expires)
+}
+
+// SuppressionStore keeps the recipients that the Service shouldn't send mails to
+// Email addresses are case insensitive
+type SuppressionStore interface {
+	// Add adds or replaces the suppression of the recipient
+	Add(s *Suppression) error
+	// Get returns the suppression of the recipient, it returns nil if the recipient is not suppressed
+	Get(recipient string) (*Suppression, error)
+	// Remove lifts the suppression of the recipient
+	Remove(recipient string) error
+	// List returns all active suppressions
+	List() ([]*Suppression, error)
+}
+
+// MemorySuppressionStore is a SuppressionStore that lives in memory
+type MemorySuppressionStore struct {
+	mu           sync.Mutex
+	suppressions map[string]*Suppression
+}
+
+// NewMemorySuppressionStore returns an empty MemorySuppressionStore
+func NewMemorySuppressionStore() *MemorySuppressionStore {
+	return &MemorySuppressionStore{
+		suppressions: map[string]*Suppression{},
+	}
+}
+
+// Add adds or replaces the suppression of the recipient
+func (m *MemorySuppressionStore) Add(s *Suppression) error {
+	if s.Recipient == "" {
+		return errors.New("suppression recipient is empty")
+	}
+	suppression := *s
+	if suppression.Created.IsZero() {
+		suppression.Created = time.Now()
+	}
+	m.mu.Lock()
+	m.suppressions[strings.ToLower(s.Recipient)] = &suppression
+	m.mu.Unlock()
+	return nil
+}
+
+// Get returns the suppression of the recipient, it returns nil if the recipient is not suppressed
+func (m *MemorySuppressionStore) Get(recipient string) (*Suppression, error) {
+	key := strings.ToLower(recipient)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	suppression, ok := m.suppressions[key]
+	if !ok {
+		return nil, nil
+	}
+	if suppression.expired(time.Now()) {
+		delete(m.suppressions, key)
+		return nil, nil
+	}
+	copied := *suppression
+	return &copied, nil
+}
+
+// Remove lifts the suppression of the recipient
+func (m *MemorySuppressionStore) Remove(recipient string) error {
+	m.mu.Lock()
+	delete(m.suppressions, strings.ToLower(recipient))
+	m.mu.Unlock()
+	return nil
+}
+
+// List returns all active suppressions sorted by the recipients
+func (m *MemorySuppressionStore) List() ([]*Suppression, error) {
+	now := time.Now()
+	m.mu.Lock()
+	var list []*Suppression
+	for key, suppression := range m.suppressions {
+		if suppression.expired(now) {
+			delete(m.suppressions, key)
+			continue
+		}
+		copied := *suppression
+		list = append(list, &copied)
+	}
+	m.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Recipient < list[j].Recipient
+	})
+	return list, nil
+}
+
+// FileSuppressionStore is a SuppressionStore that persists the suppressions to a JSON file
+// The file is rewritten on every change
+type FileSuppressionStore struct {
+	path   string
+	memory *MemorySuppressionStore
+	mu     sync.Mutex
+}
+
+// NewFileSuppressionStore returns a FileSuppressionStore that loads the suppressions from the path if it exists
+func NewFileSuppressionStore(path string) (*FileSuppressionStore, error) {
+	store := &FileSuppressionStore{
+		path:   path,
+		memory: NewMemorySuppressionStore(),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading suppression file failed")
+	}
+	var suppressions []*Suppression
+	err = json.Unmarshal(data, &suppressions)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing suppression file failed")
+	}
+	for _, suppression := range suppressions {
+		err = store.memory.Add(suppression)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// Add adds or replaces the suppression of the recipient
+func (f *FileSuppressionStore) Add(s *Suppression) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.memory.Add(s)
+	if err != nil {
+		return err
+	}
+	return f.save()
+}
+
+// Get returns the suppression of the recipient, it returns nil if the recipient is not suppressed
+func (f *FileSuppressionStore) Get(recipient string) (*Suppression, error) {
+	return f.memory.Get(recipient)
+}
+
+// Remove lifts the suppression of the recipient
+func (f *FileSuppressionStore) Remove(recipient string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.memory.Remove(recipient)
+	if err != nil {
+		return err
+	}
+	return f.save()
+}
+
+// List returns all active suppressions sorted by the recipients
+func (f *FileSuppressionStore) List() ([]*Suppression, error) {
+	return f.memory.List()
+}
+
+// save writes the suppressions to a temporary file and renames it over the old file
+func (f *FileSuppressionStore) save() error {
+	suppressions, err := f.memory.List()
+	if err != nil {
+		return err
+	}
+	if suppressions == nil {
+		suppressions = []*Suppression{}
+	}
+	data, err := json.MarshalIndent(suppressions, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "writing suppression file failed")
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "writing suppression file failed")
+	}
+	err = os.Rename(tmp.Name(), f.path)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "writing suppression file failed")
+	}
+	return nil
+}
+
+// suppressed reports whether the recipient is in the suppression list of the service
+func (s *Service) suppressed(recipient string) bool {
+	if s.Suppressions == nil {
+		return false
+	}
+	suppression, err := s.Suppressions.Get(recipient)
+	return err == nil && suppression != nil
+}
+
+// suppressFailure adds the recipient to the suppression list if the mailbox doesn't exist (5.1.x)
+// Only the replies to the recipient itself count, a rejected sender such as 5.1.8 fails all recipients
+func (s *Service) suppressFailure(result *Result) {
+	if s.Suppressions == nil || result.Status != Failed || !result.Rejected {
+		return
+	}
+	smtpErr, ok := result.Err.(*smtp.SMTPError)
+	if !ok || smtpErr.EnhancedCode[0] != 5 || smtpErr.EnhancedCode[1] != 1 {
+		return
+	}
+	s.suppress(result.Recipient, SuppressionBounce, smtpReply(smtpErr))
+}
+
+func (s *Service) suppress(recipient string, reason string, diagnostic string) error {
+	now := time.Now()
+	suppression := &Suppression{
+		Recipient:  recipient,
+		Reason:     reason,
+		Diagnostic: diagnostic,
+		Created:    now,
+	}
+	if s.SuppressionTTL > 0 {
+		suppression.Expires = now.Add(s.SuppressionTTL)
+	}
+	return s.Suppressions.Add(suppression)
+}
+
+// HandleBounce adds the recipients that failed permanently with 5.1.x status codes in the bounce to the suppression list
+// It is a no-op if the service doesn't have a suppression list
+func (s *Service) HandleBounce(b *Bounce) error {
+	if s.Suppressions == nil {
+		return nil
+	}
+	for _, recipient := range b.Recipients {
+		if recipient.Action != ActionFailed || !strings.HasPrefix(recipient.Status, "5.1.") || recipient.Recipient == "" {
+			continue
+		}
+		err := s.suppress(recipient.Recipient, SuppressionBounce, recipient.Diagnostic)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
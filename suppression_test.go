@@ -0,0 +1,160 @@
+package ms
+
+import (
+	"github.com/cevatbarisyilmaz/ms/smtp"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemorySuppressionStore(t *testing.T) {
+	store := NewMemorySuppressionStore()
+	err := store.Add(&Suppression{Recipient: "Joe@Example.com", Reason: SuppressionManual})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Add(&Suppression{Recipient: "old@example.com", Reason: SuppressionBounce, Expires: time.Now().Add(-time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	suppression, err := store.Get("joe@example.com")
+	if err != nil || suppression == nil || suppression.Reason != SuppressionManual || suppression.Created.IsZero() {
+		t.Fatal("Invalid suppression:", suppression, err)
+	}
+	suppression, err = store.Get("old@example.com")
+	if err != nil || suppression != nil {
+		t.Fatal("Expired suppression is returned:", suppression, err)
+	}
+	list, err := store.List()
+	if err != nil || len(list) != 1 {
+		t.Fatal("Invalid list:", list, err)
+	}
+	err = store.Remove("JOE@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	suppression, err = store.Get("joe@example.com")
+	if err != nil || suppression != nil {
+		t.Fatal("Removed suppression is returned:", suppression, err)
+	}
+}
+
+func TestFileSuppressionStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "suppressions.json")
+
+	store, err := NewFileSuppressionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Add(&Suppression{Recipient: "joe@example.com", Reason: SuppressionComplaint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Add(&Suppression{Recipient: "jane@example.com", Reason: SuppressionComplaint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Remove("jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = NewFileSuppressionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := store.List()
+	if err != nil || len(list) != 1 || list[0].Recipient != "joe@example.com" || list[0].Reason != SuppressionComplaint {
+		t.Fatal("Invalid list:", list, err)
+	}
+}
+
+func TestService_suppressions(t *testing.T) {
+	s := &Service{Suppressions: NewMemorySuppressionStore()}
+	s.suppressFailure(&Result{
+		Recipient: "joe@example.com",
+		Status:    Failed,
+		Err:       &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"},
+		Rejected:  true,
+	})
+	s.suppressFailure(&Result{
+		Recipient: "jane@example.com",
+		Status:    Failed,
+		Err:       &smtp.SMTPError{Code: 552, EnhancedCode: smtp.EnhancedCode{5, 2, 2}, Message: "Mailbox full"},
+		Rejected:  true,
+	})
+	if !s.suppressed("joe@example.com") {
+		t.Error("Recipient with 5.1.1 failure is not suppressed")
+	}
+	if s.suppressed("jane@example.com") {
+		t.Error("Recipient with 5.2.2 failure is suppressed")
+	}
+	results := s.deliverTo(&delivery{sender: "sender@example.org"}, nil, []string{"joe@example.com"})
+	if len(results) != 1 || results[0].Status != Suppressed || results[0].Err != ErrSuppressed {
+		t.Errorf("Invalid results: %+v", results)
+	}
+
+	err := s.HandleBounce(&Bounce{Recipients: []*BounceRecipient{
+		{Recipient: "bob@example.com", Action: ActionFailed, Status: "5.1.2"},
+		{Recipient: "ann@example.com", Action: ActionDelayed, Status: "4.4.1"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.suppressed("bob@example.com") || s.suppressed("ann@example.com") {
+		t.Error("Bounce is not handled properly")
+	}
+}
+
+func TestService_suppressions_rejectedSender(t *testing.T) {
+	for _, e := range []struct {
+		command    string
+		reply      string
+		suppressed bool
+	}{
+		{"MAIL", "550 5.1.8 Bad sender address", false},
+		{"RCPT", "550 5.1.1 No such user", true},
+	} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			conn, err := l.Accept()
+			if err == nil {
+				fakeServer(conn, map[string]string{e.command: e.reply})
+			}
+		}()
+		s := newTestService(t)
+		s.Suppressions = NewMemorySuppressionStore()
+		s.Transport = &RelayTransport{Addr: l.Addr().String()}
+		report, err := s.Deliver(&Mail{
+			Headers: map[string][]byte{
+				"From": []byte("joe@example.org"),
+				"To":   []byte("jane@example.com, ann@example.net"),
+			},
+			Body: []byte("Hello"),
+		})
+		l.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, recipient := range []string{"jane@example.com", "ann@example.net"} {
+			result := report.Recipients[recipient]
+			if result.Status != Failed || result.Rejected != e.suppressed {
+				t.Errorf("%s: invalid result of %s: %v %v %v", e.command, recipient, result.Status, result.Err, result.Rejected)
+			}
+			if s.suppressed(recipient) != e.suppressed {
+				t.Errorf("%s: suppression of %s is %v, expected %v", e.command, recipient, s.suppressed(recipient), e.suppressed)
+			}
+		}
+	}
+}
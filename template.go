@@ -0,0 +1,162 @@
+package ms
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Template renders personalized mails from templates of the subject, the plain text body and the HTML body
+// The templates are executed with the data of each recipient, the HTML template escapes the data automatically
+// Referring to a missing variable is an error
+type Template struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// Recipient is a recipient of a templated mail with its data to render the templates with
+type Recipient struct {
+	// Address is the email address of the recipient such as "Joe <joe@example.com>"
+	Address string
+	Data    interface{}
+}
+
+// NewTemplate parses the templates of the subject, the plain text body and the HTML body
+// Either text or html can be empty to leave out that version of the body
+func NewTemplate(subject string, text string, html string) (*Template, error) {
+	if text == "" && html == "" {
+		return nil, errors.New("either text or html template must be supplied")
+	}
+	t := &Template{}
+	var err error
+	t.subject, err = texttemplate.New("subject").Option("missingkey=error").Parse(subject)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing subject template failed")
+	}
+	if text != "" {
+		t.text, err = texttemplate.New("text").Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing text template failed")
+		}
+	}
+	if html != "" {
+		t.html, err = htmltemplate.New("html").Option("missingkey=error").Parse(html)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing html template failed")
+		}
+	}
+	return t, nil
+}
+
+// Render renders the mail from the sender to a single recipient with the data
+func (t *Template) Render(from string, to string, data interface{}) (*Mail, error) {
+	var subject bytes.Buffer
+	err := t.subject.Execute(&subject, data)
+	if err != nil {
+		return nil, errors.Wrap(err, "rendering subject failed")
+	}
+	if strings.ContainsAny(subject.String(), "\r\n") {
+		return nil, errors.New("rendered subject must not contain line breaks")
+	}
+	var text, html bytes.Buffer
+	if t.text != nil {
+		err = t.text.Execute(&text, data)
+		if err != nil {
+			return nil, errors.Wrap(err, "rendering text failed")
+		}
+	}
+	if t.html != nil {
+		err = t.html.Execute(&html, data)
+		if err != nil {
+			return nil, errors.Wrap(err, "rendering html failed")
+		}
+	}
+	m := &Mail{
+		Headers: map[string][]byte{
+			"From":         []byte(from),
+			"To":           []byte(to),
+			"Subject":      []byte(mime.QEncoding.Encode("utf-8", subject.String())),
+			"MIME-Version": []byte("1.0"),
+		},
+	}
+	switch {
+	case t.text == nil:
+		m.Headers["Content-Type"] = []byte("text/html; charset=utf-8")
+		m.Headers["Content-Transfer-Encoding"] = []byte("quoted-printable")
+		m.Body, err = encodeQuotedPrintable(html.Bytes())
+	case t.html == nil:
+		m.Headers["Content-Type"] = []byte("text/plain; charset=utf-8")
+		m.Headers["Content-Transfer-Encoding"] = []byte("quoted-printable")
+		m.Body, err = encodeQuotedPrintable(text.Bytes())
+	default:
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		err = writeQuotedPrintablePart(writer, "text/plain; charset=utf-8", text.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		err = writeQuotedPrintablePart(writer, "text/html; charset=utf-8", html.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		err = writer.Close()
+		m.Headers["Content-Type"] = []byte("multipart/alternative; boundary=" + writer.Boundary())
+		m.Body = body.Bytes()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// RenderAll renders the mails from the sender to each recipient
+// It fails without returning any mails if a mail of any recipient fails to render,
+// so the errors such as missing variables are reported before any delivery is attempted
+func (t *Template) RenderAll(from string, recipients []*Recipient) ([]*Mail, error) {
+	mails := make([]*Mail, 0, len(recipients))
+	for _, recipient := range recipients {
+		m, err := t.Render(from, recipient.Address, recipient.Data)
+		if err != nil {
+			return nil, errors.Wrap(err, "rendering mail to "+recipient.Address+" failed")
+		}
+		mails = append(mails, m)
+	}
+	return mails, nil
+}
+
+func encodeQuotedPrintable(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := quotedprintable.NewWriter(&buffer)
+	_, err := writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func writeQuotedPrintablePart(writer *multipart.Writer, contentType string, data []byte) error {
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	encoded, err := encodeQuotedPrintable(data)
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(encoded)
+	return err
+}
@@ -0,0 +1,86 @@
+package ms
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"strings"
+	"testing"
+)
+
+func TestTemplate(t *testing.T) {
+	tmpl, err := NewTemplate(
+		"Welcome {{.Name}}",
+		"Hi {{.Name}},\nYour code is {{.Code}}.\n",
+		"<p>Hi {{.Name}}, your code is <b>{{.Code}}</b>.</p>",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := tmpl.Render("noreply@example.org", "jöe@example.com", map[string]string{"Name": "Jöe <admin>", "Code": "1234"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(string(m.Headers["Subject"]))
+	if err != nil || subject != "Welcome Jöe <admin>" {
+		t.Error("Invalid subject:", string(m.Headers["Subject"]), err)
+	}
+	mediaType, params, err := mime.ParseMediaType(string(m.Headers["Content-Type"]))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatal("Invalid content type:", string(m.Headers["Content-Type"]), err)
+	}
+	reader := multipart.NewReader(bytes.NewReader(m.Body), params["boundary"])
+	var bodies []string
+	for {
+		part, err := reader.NextRawPart()
+		if err != nil {
+			break
+		}
+		body, err := ioutil.ReadAll(quotedprintable.NewReader(part))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodies = append(bodies, string(body))
+	}
+	if len(bodies) != 2 {
+		t.Fatal("Invalid number of parts:", len(bodies))
+	}
+	if bodies[0] != "Hi Jöe <admin>,\r\nYour code is 1234.\r\n" {
+		t.Errorf("Invalid text: %q", bodies[0])
+	}
+	if !strings.Contains(bodies[1], "Hi Jöe &lt;admin&gt;") {
+		t.Errorf("HTML is not escaped: %q", bodies[1])
+	}
+
+	_, err = tmpl.RenderAll("noreply@example.org", []*Recipient{
+		{Address: "joe@example.com", Data: map[string]string{"Name": "Joe", "Code": "1234"}},
+		{Address: "jane@example.com", Data: map[string]string{"Name": "Jane"}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "jane@example.com") {
+		t.Error("Missing variable is not reported:", err)
+	}
+
+	_, err = tmpl.Render("noreply@example.org", "joe@example.com", struct{ Name string }{"Joe"})
+	if err == nil {
+		t.Error("Missing field is not reported")
+	}
+}
+
+func TestTemplate_textOnly(t *testing.T) {
+	tmpl, err := NewTemplate("Hello", "Hello {{.}}", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := tmpl.Render("noreply@example.org", "joe@example.com", "Joe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m.Headers["Content-Type"]) != "text/plain; charset=utf-8" || string(m.Body) != "Hello Joe" {
+		t.Errorf("Invalid mail: %q %q", m.Headers["Content-Type"], m.Body)
+	}
+	if _, err = NewTemplate("Hello", "", ""); err == nil {
+		t.Error("Template without a body is accepted")
+	}
+}
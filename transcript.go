@@ -0,0 +1,55 @@
+package ms
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// transcriptStream writes the lines of a conversation to Service.Transcript with a prefix identifying the attempt
+type transcriptStream struct {
+	s      *Service
+	prefix []byte
+}
+
+func (t *transcriptStream) Write(p []byte) (int, error) {
+	var buffer bytes.Buffer
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		buffer.Write(t.prefix)
+		buffer.Write(line)
+	}
+	t.s.transcriptMu.Lock()
+	defer t.s.transcriptMu.Unlock()
+	_, err := t.s.Transcript.Write(buffer.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// transcript returns the writer to capture the conversation of the attempt to the recipients with
+// It is nil if transcripts are disabled
+func (s *Service) transcript(d *delivery, recipients []string, attempt *Attempt, buffer *bytes.Buffer) io.Writer {
+	var writers []io.Writer
+	if s.Transcripts {
+		writers = append(writers, buffer)
+	}
+	if s.Transcript != nil {
+		prefix := d.messageID + " " + strings.Join(recipients, ",") + " " + attempt.MX
+		if attempt.IP != nil {
+			prefix += "[" + attempt.IP.String() + "]"
+		}
+		prefix += " "
+		writers = append(writers, &transcriptStream{s: s, prefix: []byte(prefix)})
+	}
+	switch len(writers) {
+	case 0:
+		return nil
+	case 1:
+		return writers[0]
+	}
+	return io.MultiWriter(writers...)
+}
@@ -0,0 +1,33 @@
+package ms
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestService_transcript(t *testing.T) {
+	var stream bytes.Buffer
+	s := &Service{}
+	d := &delivery{messageID: "<1@example.org>"}
+	attempt := &Attempt{MX: "mx.example.com", IP: net.ParseIP("192.0.2.1")}
+	var buffer bytes.Buffer
+	if s.transcript(d, []string{"joe@example.com"}, attempt, &buffer) != nil {
+		t.Fatal("Transcript is captured while disabled")
+	}
+	s.Transcripts = true
+	s.Transcript = &stream
+	w := s.transcript(d, []string{"joe@example.com"}, attempt, &buffer)
+	_, err := w.Write([]byte("S: 220 mx.example.com\r\nC: EHLO mta.example.org\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buffer.String() != "S: 220 mx.example.com\r\nC: EHLO mta.example.org\r\n" {
+		t.Errorf("Invalid attached transcript: %q", buffer.String())
+	}
+	expected := "<1@example.org> joe@example.com mx.example.com[192.0.2.1] S: 220 mx.example.com\r\n" +
+		"<1@example.org> joe@example.com mx.example.com[192.0.2.1] C: EHLO mta.example.org\r\n"
+	if stream.String() != expected {
+		t.Errorf("Invalid streamed transcript: %q", stream.String())
+	}
+}
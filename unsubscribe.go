@@ -0,0 +1,171 @@
+package ms
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/pkg/errors"
+	"html/template"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SuppressionUnsubscribe is used for the recipients that unsubscribed
+const SuppressionUnsubscribe = "unsubscribe"
+
+// unsubscribeSubjectPrefix precedes the token in the subject of the unsubscribe mails
+const unsubscribeSubjectPrefix = "unsubscribe:"
+
+// ErrInvalidToken is returned for unsubscribe tokens that are malformed or not signed with the secret
+var ErrInvalidToken = errors.New("invalid unsubscribe token")
+
+// Unsubscriber provides one-click unsubscription (RFC 8058)
+// It adds List-Unsubscribe headers with signed per-recipient tokens to the mails
+// and adds the recipients following them to the suppression list
+// Set Service.Unsubscriber to add the headers to the mails with a single recipient, such as the ones of campaigns
+type Unsubscriber struct {
+	// Secret is the key to sign the tokens with, it should be long and random
+	Secret []byte
+	// URL is the HTTPS address the Unsubscriber is served at such as "https://example.org/unsubscribe"
+	URL string
+	// Mailto is the address receiving the unsubscribe mails such as "unsubscribe@example.org", it is optional
+	// The mails received at the address should be passed to HandleMail
+	Mailto string
+	// Suppressions is the suppression list to add the unsubscribed recipients to
+	Suppressions SuppressionStore
+}
+
+// Token returns the signed token of the recipient
+func (u *Unsubscriber) Token(recipient string) string {
+	recipient = strings.ToLower(recipient)
+	return base64.RawURLEncoding.EncodeToString([]byte(recipient)) + "." +
+		base64.RawURLEncoding.EncodeToString(u.sign(recipient))
+}
+
+// Verify returns the recipient of the token if it is signed with the secret
+func (u *Unsubscriber) Verify(token string) (string, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return "", ErrInvalidToken
+	}
+	recipient, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	if !hmac.Equal(signature, u.sign(string(recipient))) {
+		return "", ErrInvalidToken
+	}
+	return string(recipient), nil
+}
+
+func (u *Unsubscriber) sign(recipient string) []byte {
+	mac := hmac.New(sha256.New, u.Secret)
+	mac.Write([]byte(recipient))
+	return mac.Sum(nil)
+}
+
+// Headers returns the List-Unsubscribe and List-Unsubscribe-Post headers for the recipient
+func (u *Unsubscriber) Headers(recipient string) map[string][]byte {
+	token := u.Token(recipient)
+	var links []string
+	if u.URL != "" {
+		link := u.URL
+		if strings.Contains(link, "?") {
+			link += "&"
+		} else {
+			link += "?"
+		}
+		links = append(links, "<"+link+"token="+token+">")
+	}
+	if u.Mailto != "" {
+		links = append(links, "<mailto:"+u.Mailto+"?subject="+unsubscribeSubjectPrefix+token+">")
+	}
+	headers := map[string][]byte{}
+	if len(links) == 0 {
+		return headers
+	}
+	headers["List-Unsubscribe"] = []byte(strings.Join(links, ", "))
+	if u.URL != "" {
+		headers["List-Unsubscribe-Post"] = []byte("List-Unsubscribe=One-Click")
+	}
+	return headers
+}
+
+// unsubscribe adds the recipient of the token to the suppression list
+func (u *Unsubscriber) unsubscribe(token string) error {
+	recipient, err := u.Verify(token)
+	if err != nil {
+		return err
+	}
+	if u.Suppressions == nil {
+		return nil
+	}
+	return u.Suppressions.Add(&Suppression{
+		Recipient: recipient,
+		Reason:    SuppressionUnsubscribe,
+		Created:   time.Now(),
+	})
+}
+
+// HandleMail unsubscribes the recipient of the token in the subject of a mail sent to the Mailto address
+func (u *Unsubscriber) HandleMail(r io.Reader) error {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return errors.Wrap(err, "reading unsubscribe mail failed")
+	}
+	subject := strings.TrimSpace(msg.Header.Get("Subject"))
+	if !strings.HasPrefix(strings.ToLower(subject), unsubscribeSubjectPrefix) {
+		return ErrInvalidToken
+	}
+	return u.unsubscribe(strings.TrimSpace(subject[len(unsubscribeSubjectPrefix):]))
+}
+
+// ServeHTTP unsubscribes the recipient of the token with one-click POST requests (RFC 8058)
+// GET requests are answered with a confirmation form instead, since mail scanners may follow the links
+func (u *Unsubscriber) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	switch r.Method {
+	case http.MethodGet:
+		if _, err := u.Verify(token); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		unsubscribeTemplate.Execute(w, "?token="+url.QueryEscape(token))
+	case http.MethodPost:
+		err := u.unsubscribe(token)
+		if err == ErrInvalidToken {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "unsubscribing failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, "You are unsubscribed.\n")
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+var unsubscribeTemplate = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Unsubscribe</title></head>
+<body>
+<form method="post" action="{{.}}">
+<input type="hidden" name="List-Unsubscribe" value="One-Click">
+<button>Unsubscribe</button>
+</form>
+</body>
+</html>
+`))
@@ -0,0 +1,88 @@
+package ms
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestUnsubscriber(t *testing.T) {
+	u := &Unsubscriber{
+		Secret:       []byte("secret"),
+		URL:          "https://example.org/unsubscribe",
+		Mailto:       "unsubscribe@example.org",
+		Suppressions: NewMemorySuppressionStore(),
+	}
+	token := u.Token("Joe@Example.com")
+	if recipient, err := u.Verify(token); err != nil || recipient != "joe@example.com" {
+		t.Fatal("Token is not verified:", recipient, err)
+	}
+	forged := &Unsubscriber{Secret: []byte("other")}
+	if _, err := u.Verify(forged.Token("joe@example.com")); err != ErrInvalidToken {
+		t.Fatal("Forged token is verified")
+	}
+
+	headers := u.Headers("joe@example.com")
+	expected := "<https://example.org/unsubscribe?token=" + token + ">, <mailto:unsubscribe@example.org?subject=unsubscribe:" + token + ">"
+	if string(headers["List-Unsubscribe"]) != expected || string(headers["List-Unsubscribe-Post"]) != "List-Unsubscribe=One-Click" {
+		t.Errorf("Invalid headers: %q", headers)
+	}
+
+	srv := httptest.NewServer(u)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "?token=" + token)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("Confirmation page failed:", resp, err)
+	}
+	resp.Body.Close()
+	if suppression, _ := u.Suppressions.Get("joe@example.com"); suppression != nil {
+		t.Fatal("GET request unsubscribed")
+	}
+	resp, err = http.Post(srv.URL+"?token=forged", "application/x-www-form-urlencoded", strings.NewReader("List-Unsubscribe=One-Click"))
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Invalid token is accepted:", resp, err)
+	}
+	resp.Body.Close()
+	resp, err = http.Post(srv.URL+"?token="+token, "application/x-www-form-urlencoded", strings.NewReader("List-Unsubscribe=One-Click"))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("Unsubscribing failed:", resp, err)
+	}
+	resp.Body.Close()
+	if suppression, _ := u.Suppressions.Get("joe@example.com"); suppression == nil || suppression.Reason != SuppressionUnsubscribe {
+		t.Fatal("Recipient is not suppressed:", suppression)
+	}
+
+	err = u.HandleMail(strings.NewReader("From: jane@example.com\r\nSubject: unsubscribe:" + u.Token("jane@example.com") + "\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if suppression, _ := u.Suppressions.Get("jane@example.com"); suppression == nil {
+		t.Fatal("Recipient of the mail is not suppressed")
+	}
+}
+
+func TestService_unsubscribeHeaders(t *testing.T) {
+	transport := &MemoryTransport{}
+	s := newTestService(t)
+	s.Transport = transport
+	s.Unsubscriber = &Unsubscriber{Secret: []byte("secret"), URL: "https://example.org/unsubscribe"}
+	campaign := s.NewCampaign(&Mail{
+		Headers: map[string][]byte{"From": []byte("news@example.org"), "Subject": []byte("News")},
+		Body:    []byte("News"),
+	}, []*Recipient{{Address: "joe@example.com"}})
+	err := campaign.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := string(transport.Mails()[0].Data)
+	if !strings.Contains(data, "List-Unsubscribe: <https://example.org/unsubscribe?token="+s.Unsubscriber.Token("joe@example.com")+">\r\n") {
+		t.Fatalf("List-Unsubscribe header is missing: %q", data)
+	}
+	signed := regexp.MustCompile(`[; ]h=([^;]*);`).FindStringSubmatch(strings.Replace(data, "\r\n ", "", -1))
+	if signed == nil || !strings.Contains(signed[1], "List-Unsubscribe") || !strings.Contains(signed[1], "List-Unsubscribe-Post") {
+		t.Error("List-Unsubscribe headers are not signed:", signed)
+	}
+}
@@ -0,0 +1,49 @@
+package ms
+
+import (
+	"strings"
+)
+
+// VERP encodes the recipient into the envelope sender as described in
+// Variable Envelope Return Paths, such as bounces+someuser=somedomain.com@yourdomain.com
+// for the sender bounces@yourdomain.com and the recipient someuser@somedomain.com
+// Bounces sent to the returned address can be traced back to the recipient with DecodeVERP
+// The sender is returned as it is if its local part contains +, since DecodeVERP splits the address at the first +
+func VERP(sender string, recipient string) string {
+	senderLocal, senderDomain, ok := splitAddr(sender)
+	if !ok || strings.IndexByte(senderLocal, '+') >= 0 {
+		return sender
+	}
+	recipientLocal, recipientDomain, ok := splitAddr(recipient)
+	if !ok {
+		return sender
+	}
+	return senderLocal + "+" + recipientLocal + "=" + recipientDomain + "@" + senderDomain
+}
+
+// DecodeVERP reverses VERP and returns the original sender and recipient
+// ok is false if the address is not VERP encoded
+func DecodeVERP(addr string) (sender string, recipient string, ok bool) {
+	local, domain, ok := splitAddr(addr)
+	if !ok {
+		return "", "", false
+	}
+	plus := strings.IndexByte(local, '+')
+	if plus < 0 {
+		return "", "", false
+	}
+	encoded := local[plus+1:]
+	equals := strings.LastIndexByte(encoded, '=')
+	if equals <= 0 || equals == len(encoded)-1 {
+		return "", "", false
+	}
+	return local[:plus] + "@" + domain, encoded[:equals] + "@" + encoded[equals+1:], true
+}
+
+func splitAddr(addr string) (local string, domain string, ok bool) {
+	at := strings.LastIndexByte(addr, '@')
+	if at <= 0 || at == len(addr)-1 {
+		return "", "", false
+	}
+	return addr[:at], addr[at+1:], true
+}